@@ -0,0 +1,173 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Attachments are committed along with the message
+// under attachments/<content hash>/<file name>
+const attachmentsDir string = "attachments"
+
+const maxAttachmentSize int64 = 10 << 20
+
+type attachment struct {
+	name string
+	data []byte
+}
+
+// writeAttachment puts the attachment into the worktree and returns
+// its path in the repo
+func writeAttachment(r *git.Repository, att *attachment) (string, error) {
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return "", err
+	}
+
+	hash := plumbing.ComputeHash(plumbing.BlobObject, att.data)
+	fileName := path.Join(attachmentsDir, hash.String(), att.name)
+
+	f, err := w.Filesystem.Create(fileName)
+	if err != nil {
+		appConfig.LogErr(err, "creating file %s", fileName)
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(att.data)
+	if err != nil {
+		appConfig.LogErr(err, "writing file %s", fileName)
+		return "", err
+	}
+	return fileName, nil
+}
+
+// dropAttachment removes the attachment of the message that failed to commit
+func dropAttachment(r *git.Repository, fileName string) {
+	if fileName == "" {
+		return
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return
+	}
+
+	if _, err := w.Remove(fileName); err != nil {
+		w.Filesystem.Remove(fileName)
+	}
+}
+
+// SendAttachment sends the file from the local path with the text
+// to the current chat
+func SendAttachment(filePath, text string) (Chat, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		appConfig.LogErr(err, "attaching %s", filePath)
+		return Chat{}, err
+	}
+
+	if info.IsDir() || strings.ContainsAny(info.Name(), "\r\n") {
+		err = errors.New("not a regular file")
+		appConfig.LogErr(err, "attaching %s", filePath)
+		return Chat{}, err
+	}
+
+	if info.Size() > maxAttachmentSize {
+		appConfig.LogErr(ErrAttachmentSize, "attaching %s of %d bytes", filePath, info.Size())
+		return Chat{}, ErrAttachmentSize
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		appConfig.LogErr(err, "reading %s", filePath)
+		return Chat{}, err
+	}
+
+	return sendMsg(&attachment{name: info.Name(), data: data}, text)
+}
+
+// AttachmentName returns the file name of the message attachment
+func AttachmentName(m Message) string {
+	if m.Attachment == "" {
+		return ""
+	}
+	return path.Base(m.Attachment)
+}
+
+// SaveAttachment writes the attachment of the message in the current chat
+// to the local path. If the path is a directory, the attachment keeps its name
+func SaveAttachment(hash, dest string) (string, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return "", ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		appConfig.LogErr(err, "retrieving message %s", hash)
+		return "", err
+	}
+
+	m := msgFromCommit(c)
+	if m.Attachment == "" {
+		appConfig.LogErr(ErrNoAttachment, "message %s", hash)
+		return "", ErrNoAttachment
+	}
+
+	f, err := c.File(m.Attachment)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving file %s", m.Attachment)
+		return "", err
+	}
+
+	if strings.HasPrefix(dest, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			dest = filepath.Join(home, dest[2:])
+		}
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, AttachmentName(m))
+	}
+
+	src, err := f.Reader()
+	if err != nil {
+		appConfig.LogErr(err, "reading file %s", m.Attachment)
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dest)
+	if err != nil {
+		appConfig.LogErr(err, "creating file %s", dest)
+		return "", err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		appConfig.LogErr(err, "writing file %s", dest)
+		return "", err
+	}
+	appConfig.LogDebug("Save attachment %s to %s", m.Attachment, dest)
+
+	return dest, nil
+}
@@ -2,15 +2,18 @@ package client
 
 import (
 	"bufio"
+	"container/heap"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -40,25 +43,77 @@ var (
 	ErrCommitChatInfo  = errors.New("failed to commit chat info, remove file")
 	ErrPushChatInfo    = errors.New("failed to push chat info, reset commit")
 	ErrResetLastCommit = errors.New("failed to reset last commit, remove chat")
+
+	ErrInvalidTopicName = errors.New("invalid topic name")
+	ErrTopicExists      = errors.New("topic already exists")
+	ErrTopicNotFound    = errors.New("topic not found")
+	ErrNothingToMerge   = errors.New("topic has nothing to merge")
+	ErrPushRejected     = errors.New("push rejected by remote")
+	ErrArchiveExists    = errors.New("archived topic already exists")
+	ErrNotMsgAuthor     = errors.New("not an author of the message")
+	ErrMsgDeleted       = errors.New("message is deleted")
+	ErrInvalidReaction  = errors.New("invalid reaction")
+	ErrAttachmentSize   = errors.New("attachment is too big")
+	ErrNoAttachment     = errors.New("message has no attachment")
+	ErrInvalidQuery     = errors.New("invalid search query")
+	ErrMemberNotFound   = errors.New("member not found")
+	ErrInvalidName      = errors.New("invalid visible name")
+	ErrTopicSelected    = errors.New("topic is selected")
+	ErrNotPermitted     = errors.New("not permitted by role")
+	ErrSigningKey       = errors.New("failed to load signing key")
+	ErrKeyPublished     = errors.New("signing key already published")
 )
 
 type Message struct {
-	Text   string
-	Author string
-	Time   time.Time
+	Text        string
+	Author      string
+	Time        time.Time
+	Hash        string
+	ReplyTo     string
+	Edits       string
+	Edited      bool
+	EditTime    time.Time
+	History     []Message
+	Retracts    string
+	Deleted     bool
+	Reactions   map[string]string
+	SeenBy      []string
+	MergedTopic string
+	// MsgId is the same for the message replayed after somebody else
+	// pushed first, unlike its hash
+	MsgId string
+	// Pending messages wait in the outbox for the server
+	Pending bool
+	// Signature tells whether the message is signed by a key of a member,
+	// Signer is that member
+	Signature SignatureState
+	Signer    string
+
+	Attachment     string
+	AttachmentSize int64
 }
 
 type chatMember struct {
 	Username    string    `json:"Username"`
 	VisibleName string    `json:"VisibleName"`
 	Activity    time.Time `json:"Activity"`
+	Role        Role      `json:"Role,omitempty"`
+	// SigningKey is the public key the member signs messages with
+	SigningKey string `json:"SigningKey,omitempty"`
+
+	// Fields of newer clients, kept when the member is written back
+	unknown map[string]json.RawMessage
 }
 
 type ChatInfoJson struct {
-	Url        *url.URL     `json:"url"`
-	Name       string       `json:"name"`
-	MembersNum int          `json:"membersNum"`
-	Members    []chatMember `json:"members"`
+	SchemaVersion int          `json:"schemaVersion"`
+	Url           *url.URL     `json:"url"`
+	Name          string       `json:"name"`
+	MembersNum    int          `json:"membersNum"`
+	Members       []chatMember `json:"members"`
+
+	// Fields of newer clients, kept when info.json is written back
+	unknown map[string]json.RawMessage
 }
 
 type Chat struct {
@@ -70,11 +125,19 @@ type Chat struct {
 	MsgNum        int
 	LastMsg       Message
 	NonReadMsgNum int
+	LastRead      string
+	Topic         string
+	Presence      map[string]Presence
+	mainBranch    string
 	username      string
 	password      string
+
+	heartbeatAt   time.Time
+	heartbeatIdle bool
+	membersAt     time.Time
 }
 
-func newChat(i ChatInfoJson, msgNum int, lastMsg Message, u, p string) Chat {
+func newChat(i ChatInfoJson, msgNum int, lastMsg Message, mainBranch, u, p string) Chat {
 	return Chat{
 		mu:            new(sync.Mutex),
 		Url:           i.Url,
@@ -84,14 +147,66 @@ func newChat(i ChatInfoJson, msgNum int, lastMsg Message, u, p string) Chat {
 		MsgNum:        msgNum,
 		LastMsg:       lastMsg,
 		NonReadMsgNum: 0,
+		mainBranch:    mainBranch,
 		username:      u,
 		password:      p,
 	}
 }
 
-var Chats []Chat
+// Chats and currChat are shared with polling, so they are guarded by
+// chatsMu. Chats are kept by pointer, so a chat stays where it is when
+// others are added or left
+var chatsMu sync.Mutex
+var Chats []*Chat
 var currChat *Chat
 
+// listChats returns the chats as they are now, so they can be ranged over
+// without holding chatsMu
+func listChats() []*Chat {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	return slices.Clone(Chats)
+}
+
+func addToChats(c *Chat) {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	Chats = append(Chats, c)
+}
+
+// dropFromChats takes the chat out of the list. The current chat
+// is unset, if it is the one
+func dropFromChats(c *Chat) {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	Chats = slices.DeleteFunc(slices.Clone(Chats), func(listed *Chat) bool {
+		return listed == c
+	})
+	if currChat == c {
+		currChat = nil
+	}
+}
+
+// isListed reports whether the chat is still in the list,
+// e.g. it was not left while being polled
+func isListed(c *Chat) bool {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	return slices.Contains(Chats, c)
+}
+
+func getCurrChat() *Chat {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	return currChat
+}
+
+func setCurrChat(c *Chat) {
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	currChat = c
+}
+
 var msgChann chan Message
 var updChatChann chan Chat
 
@@ -111,14 +226,20 @@ func getAuth(username, password string) (transport.AuthMethod, error) {
 func pollChatsForMsgs() {
 	go func() {
 		for {
-			for idx := range Chats {
+			for _, c := range listChats() {
 				var chatToChann Chat
-				var msgs []Message
+				var msgs, updated []Message
+				var presenceChanged bool
 				func() {
-					Chats[idx].mu.Lock()
-					defer Chats[idx].mu.Unlock()
+					c.mu.Lock()
+					defer c.mu.Unlock()
+
+					// Chat was left while waiting for its lock
+					if !isListed(c) {
+						return
+					}
 
-					chatPath, err := getChatPath(Chats[idx].Url.Path)
+					chatPath, err := getChatPath(c.Url.Path)
 					if err != nil {
 						return
 					}
@@ -133,44 +254,98 @@ func pollChatsForMsgs() {
 						appConfig.LogErr(err, "get HEAD in repo %s", chatPath)
 						return
 					}
+					branch := ref.Name().Short()
+
+					auth, _ := getAuth(c.username, c.password)
+					reactionsTip := getReactionsTip(repo)
+					receipts := getReceipts(repo, branch)
 
-					commit, err := repo.CommitObject(ref.Hash())
+					// Receipts and heartbeats of the members are not worth
+					// fetching more often than heartbeats are sent
+					var memberSpecs []config.RefSpec
+					if time.Since(c.membersAt) >= heartbeatPeriod {
+						memberSpecs = []config.RefSpec{receiptsRefSpec(), presenceRefSpec()}
+					}
+					newMsgs, err := pullMsgs(repo, ref.Hash(),
+						&git.PullOptions{RemoteName: "origin", Auth: auth}, memberSpecs...)
+					if errors.Is(err, plumbing.ErrReferenceNotFound) && c.Topic != "" {
+						// Topic was merged or closed by somebody else
+						appConfig.LogDebug("Topic %s is gone from %s", c.Topic, c.Name)
+						if checkoutBranch(repo, c.mainBranch) == nil {
+							c.Topic = ""
+						}
+						return
+					}
 					if err != nil {
-						appConfig.LogErr(err, "get commit object in repo %s", chatPath)
 						return
 					}
+					if memberSpecs != nil {
+						c.membersAt = time.Now()
+					}
+
+					isCurr := getCurrChat() == c
+					if updatePresence(c, repo, auth) && isCurr {
+						presenceChanged = true
+						chatToChann = *c
+					}
 
-					auth, _ := getAuth(Chats[idx].username, Chats[idx].password)
-					newMsgs, err := pullMsgs(repo, &commit.Committer.When,
-						&git.PullOptions{RemoteName: "origin", Auth: auth})
+					// Messages sent while the server was unreachable
+					flushed, err := flushOutbox(repo, auth)
 					if err != nil {
-						return
+						appConfig.LogErr(err, "flushing outbox of %s", c.Name)
+					}
+
+					if isCurr {
+						updated, _ = reactedMsgs(repo, reactionsTip)
+						updated = append(updated, flushed...)
+						// Only my latest message shows whether it was seen
+						if !maps.Equal(receipts, getReceipts(repo, branch)) {
+							if m, err := lastOwnMsg(repo); err == nil {
+								updated = append(updated, m)
+							}
+						}
 					}
 
-					if newMsgs == 0 {
+					// My seen messages may be replayed without any new ones,
+					// e.g. the server took them before the push failed
+					if head, err := repo.Head(); newMsgs == 0 && (err != nil || head.Hash() == ref.Hash()) {
 						return
 					}
 
-					Chats[idx].MsgNum += newMsgs
-					Chats[idx].NonReadMsgNum += newMsgs
+					c.MsgNum += newMsgs
+					c.NonReadMsgNum += newMsgs
+
+					// Somebody may have joined, changed the visible name or role
+					if info, err := mainChatInfo(repo); err == nil {
+						c.Members = info.Members
+						c.MembersNum = info.MembersNum
+					}
 
-					Chats[idx].LastMsg, err = getLastMsg(repo)
+					c.LastMsg, err = getLastMsg(repo)
 					if err != nil {
 						return
 					}
 
-					if currChat != nil && currChat.Url == Chats[idx].Url {
-						msgs, err = getMsgs(repo, &commit.Committer.When)
+					if isCurr {
+						msgs, err = getMsgs(repo, ref.Hash())
 						if err != nil {
 							return
 						}
+						// Flushed messages are among the new ones, when
+						// they were put after the pulled ones
+						updated = slices.DeleteFunc(updated, func(m Message) bool {
+							return slices.ContainsFunc(msgs, func(n Message) bool {
+								return n.Hash == m.Hash
+							})
+						})
 					}
-					chatToChann = Chats[idx]
+					chatToChann = *c
 				}()
-				if len(msgs) > 0 {
+				if len(msgs) > 0 || presenceChanged {
 					updChatChann <- chatToChann
-					printMsgs(msgs)
 				}
+				printMsgs(msgs)
+				printMsgs(updated)
 			}
 			time.Sleep(500 * time.Millisecond)
 		}
@@ -239,16 +414,40 @@ func foundMeInMembers(members []chatMember) (bool, error) {
 	return false, nil
 }
 
-func addMeToMembers(members []chatMember) ([]chatMember, error) {
+func addMeToMembers(members []chatMember, role Role) ([]chatMember, error) {
 	username, err := GetUserName()
 	if err != nil {
 		return members, err
 	}
-	me := chatMember{Username: username, VisibleName: username, Activity: time.Now()}
+	me := chatMember{
+		Username:    username,
+		VisibleName: username,
+		Activity:    time.Now(),
+		Role:        role,
+		SigningKey:  myPublicKey(),
+	}
 	members = append(members, me)
 	return members, nil
 }
 
+func commitAuthor() (*object.Signature, error) {
+	username, err := GetUserName()
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := getUserEmail()
+	if err != nil {
+		return nil, err
+	}
+
+	return &object.Signature{
+		Name:  username,
+		Email: email,
+		When:  time.Now(),
+	}, nil
+}
+
 func commit(r *git.Repository, fileName string, msg string) error {
 	w, err := r.Worktree()
 	if err != nil {
@@ -264,22 +463,14 @@ func commit(r *git.Repository, fileName string, msg string) error {
 		}
 	}
 
-	username, err := GetUserName()
-	if err != nil {
-		return err
-	}
-
-	email, err := getUserEmail()
+	author, err := commitAuthor()
 	if err != nil {
 		return err
 	}
 
 	_, err = w.Commit(msg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  username,
-			Email: email,
-			When:  time.Now(),
-		},
+		Author:            author,
+		Signer:            commitSigner(),
 		AllowEmptyCommits: (fileName == ""),
 	})
 	if err != nil {
@@ -299,6 +490,26 @@ func push(r *git.Repository, opt *git.PushOptions) error {
 	return nil
 }
 
+// isPushRejected reports whether the remote refused the push because
+// somebody else pushed first
+func isPushRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, git.ErrForceNeeded) ||
+		strings.Contains(err.Error(), "non-fast-forward") ||
+		strings.Contains(err.Error(), "rejected")
+}
+
+func fetch(r *git.Repository, opt *git.FetchOptions) error {
+	err := r.Fetch(opt)
+	if (err != nil) && (err != git.NoErrAlreadyUpToDate) {
+		appConfig.LogErr(err, "fetching from %s", opt.RemoteName)
+		return err
+	}
+	return nil
+}
+
 const infoFileName string = "info.json"
 
 func collectChatInfo(chatPath string) (ChatInfoJson, error) {
@@ -315,15 +526,7 @@ func collectChatInfo(chatPath string) (ChatInfoJson, error) {
 		return ChatInfoJson{}, err
 	}
 
-	var info ChatInfoJson
-
-	err = json.Unmarshal(byteValue, &info)
-	if err != nil {
-		appConfig.LogErr(err, "unmarshalling %s", infoFileName)
-		return ChatInfoJson{}, err
-	}
-
-	return info, nil
+	return parseChatInfo(byteValue)
 }
 
 func getChatName(chatUrl string) (string, error) {
@@ -395,7 +598,8 @@ func createChatInfo(repo *git.Repository, chatUrl string, auth transport.AuthMet
 	}
 
 	var membersArr []chatMember
-	membersArr, err = addMeToMembers(membersArr)
+	// Creator of the chat owns it
+	membersArr, err = addMeToMembers(membersArr, RoleOwner)
 	if err != nil {
 		os.Remove(chatInfoPath)
 		return ChatInfoJson{}, err
@@ -408,10 +612,11 @@ func createChatInfo(repo *git.Repository, chatUrl string, auth transport.AuthMet
 	}
 
 	info := ChatInfoJson{
-		Url:        u,
-		Name:       chatName,
-		MembersNum: len(membersArr),
-		Members:    membersArr,
+		SchemaVersion: infoSchemaVersion,
+		Url:           u,
+		Name:          chatName,
+		MembersNum:    len(membersArr),
+		Members:       membersArr,
 	}
 
 	chatInfoJsonByte, err := json.Marshal(info)
@@ -453,17 +658,17 @@ func createChatInfo(repo *git.Repository, chatUrl string, auth transport.AuthMet
 	return info, nil
 }
 
-func updateChatInfo(repo *git.Repository, info ChatInfoJson, auth transport.AuthMethod) error {
-	chatInfoJson, _ := json.Marshal(info)
-
-	chatPath, err := getChatPath(info.Url.Path)
+func writeChatInfo(chatPath string, info ChatInfoJson) error {
+	chatInfoJson, err := json.Marshal(info)
 	if err != nil {
+		appConfig.LogErr(err, "marshalling chat")
 		return err
 	}
 
 	infoFilePath := filepath.Join(chatPath, infoFileName)
 
-	f, err := os.OpenFile(infoFilePath, os.O_WRONLY, 0644)
+	// Truncate, as the new JSON may be shorter than the old one
+	f, err := os.OpenFile(infoFilePath, os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		if os.IsNotExist(err) {
 			appConfig.LogErr(err, "%s does not exist", infoFilePath)
@@ -479,20 +684,196 @@ func updateChatInfo(repo *git.Repository, info ChatInfoJson, auth transport.Auth
 		appConfig.LogErr(err, "writing to %s", infoFilePath)
 		return err
 	}
+	return nil
+}
+
+// pushChatInfo commits info.json to the main branch and pushes it.
+// A rejected commit is dropped, so it is made again over the remote one
+func pushChatInfo(r *git.Repository, chatPath, mainBranch string, info ChatInfoJson, auth transport.AuthMethod) error {
+	head, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return err
+	}
 
-	err = commit(repo, infoFileName, "Update info.json")
+	err = writeChatInfo(chatPath, info)
 	if err != nil {
 		return err
 	}
 
-	err = push(repo, &git.PushOptions{Auth: auth})
+	err = commit(r, infoFileName, "Update info.json")
 	if err != nil {
 		return err
 	}
 
+	err = push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(mainBranch)}})
+	if err != nil {
+		if w, wErr := r.Worktree(); wErr == nil {
+			w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: head.Hash()})
+		}
+		if isPushRejected(err) {
+			return ErrPushRejected
+		}
+		return err
+	}
 	return nil
 }
 
+// pullChatInfo brings the main branch up to the remote one and returns
+// info.json pushed there. My messages waiting in the outbox are put after
+// the pushed ones, so they are not lost
+func pullChatInfo(r *git.Repository, mainBranch string, auth transport.AuthMethod) (ChatInfoJson, error) {
+	_, err := rebasePending(r, mainBranch, auth)
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+	return mainChatInfo(r)
+}
+
+// updateChatInfo publishes info changed from base. If somebody else pushed
+// to the chat first, their info.json is merged with our change and pushed
+// again. The main branch has to be checked out. It returns what was pushed
+func updateChatInfo(repo *git.Repository, base, info ChatInfoJson, auth transport.AuthMethod) (ChatInfoJson, error) {
+	chatPath, err := getChatPath(info.Url.Path)
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+
+	mainBranch, err := getMainBranch(repo)
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+
+	err = withRetries(retryDelay, func() error {
+		err := pushChatInfo(repo, chatPath, mainBranch, info, auth)
+		if !errors.Is(err, ErrPushRejected) {
+			return err
+		}
+
+		theirs, pullErr := pullChatInfo(repo, mainBranch, auth)
+		if pullErr != nil {
+			return pullErr
+		}
+		info = mergeChatInfo(base, info, theirs)
+		base = theirs
+		appConfig.LogDebug("Merge %s with the pushed one", infoFileName)
+		return err
+	})
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+	return info, nil
+}
+
+const trailerTopicMerged string = "Topic-Merged"
+const trailerTopicSquashed string = "Topic-Squashed"
+const trailerReplyTo string = "Reply-To"
+const trailerEdits string = "Edits"
+const trailerRetracts string = "Retracts"
+const trailerAttachment string = "Attachment"
+const trailerMsgId string = "Msg-Id"
+
+var knownTrailers = map[string]bool{
+	trailerTopicMerged:   true,
+	trailerTopicSquashed: true,
+	trailerReplyTo:       true,
+	trailerEdits:         true,
+	trailerRetracts:      true,
+	trailerAttachment:    true,
+	trailerMsgId:         true,
+}
+
+type trailer struct {
+	key   string
+	value string
+}
+
+var trailerRe = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*): (.+)$`)
+
+// withTrailers appends git trailers, e.g. "Topic-Merged: design",
+// as the last paragraph of the commit message
+func withTrailers(text string, trailers ...trailer) string {
+	if len(trailers) == 0 {
+		return text
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(text, "\n"))
+	b.WriteString("\n\n")
+	for _, t := range trailers {
+		fmt.Fprintf(&b, "%s: %s\n", t.key, t.value)
+	}
+	return b.String()
+}
+
+// parseTrailers splits the commit message into the text and the trailers.
+// The last paragraph is treated as trailers only if all its lines are
+// trailers known to gitogram, so user text is never cut
+func parseTrailers(msg string) (string, map[string]string) {
+	msg = strings.TrimRight(msg, "\n")
+	i := strings.LastIndex(msg, "\n\n")
+	if i < 0 {
+		return msg, nil
+	}
+
+	trailers := make(map[string]string)
+	for _, line := range strings.Split(msg[i+2:], "\n") {
+		match := trailerRe.FindStringSubmatch(line)
+		if match == nil || !knownTrailers[match[1]] {
+			return msg, nil
+		}
+		trailers[match[1]] = match[2]
+	}
+	return msg[:i], trailers
+}
+
+// commitText puts the first line of the text into the commit subject
+// and the rest into the commit body, separated with a blank line
+func commitText(text string) string {
+	subject, body, ok := strings.Cut(text, "\n")
+	if !ok {
+		return text
+	}
+	return subject + "\n\n" + body
+}
+
+// msgText joins the commit subject and body back into the message text
+func msgText(msg string) string {
+	subject, body, ok := strings.Cut(msg, "\n")
+	if !ok {
+		return msg
+	}
+	return subject + "\n" + strings.TrimPrefix(body, "\n")
+}
+
+func msgFromCommit(c *object.Commit) Message {
+	text, trailers := parseTrailers(c.Message)
+	m := Message{
+		Text:        msgText(text),
+		Author:      c.Author.Name,
+		Time:        c.Author.When,
+		Hash:        c.Hash.String(),
+		ReplyTo:     trailers[trailerReplyTo],
+		Edits:       trailers[trailerEdits],
+		Retracts:    trailers[trailerRetracts],
+		MergedTopic: trailers[trailerTopicMerged],
+		Attachment:  trailers[trailerAttachment],
+		MsgId:       trailers[trailerMsgId],
+	}
+
+	// The signature is checked against keys of members by addSignatures
+	if c.PGPSignature != "" {
+		m.Signature = SignatureUnverified
+	}
+
+	if m.Attachment != "" {
+		if f, err := c.File(m.Attachment); err == nil {
+			m.AttachmentSize = f.Size
+		}
+	}
+	return m
+}
+
 func getLastMsg(r *git.Repository) (Message, error) {
 	ref, err := r.Head()
 	if err != nil {
@@ -506,11 +887,7 @@ func getLastMsg(r *git.Repository) (Message, error) {
 		return Message{}, err
 	}
 
-	return Message{
-		Text:   commit.Message,
-		Author: commit.Author.Name,
-		Time:   commit.Author.When,
-	}, nil
+	return msgFromCommit(commit), nil
 }
 
 const chatDir string = "chats"
@@ -529,41 +906,193 @@ func isGitDir(dir string) bool {
 	return err == nil
 }
 
-func pullMsgs(r *git.Repository, since *time.Time, opt *git.PullOptions) (int, error) {
-	w, err := r.Worktree()
+// commitQueue keeps commits from the most recent ones by committer time
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// Committer clocks may be skewed, so the walk looks a bit further
+// after only seen commits are left
+const walkSlop int = 5
+
+const (
+	walkFromTip  = 1
+	walkFromSeen = 2
+)
+
+// walkNewCommits calls fn for the commits reachable from the tip,
+// but not from the seen commit, like "git log seen..tip". Merged topics
+// are walked as well. The whole history is walked for zero seen hash.
+// Commits come from the most recent ones
+func walkNewCommits(r *git.Repository, tip, seen plumbing.Hash, fn func(c *object.Commit) error) error {
+	flags := make(map[plumbing.Hash]int)
+	q := &commitQueue{}
+	mark := func(hash plumbing.Hash, flag int) error {
+		if flags[hash]|flag == flags[hash] {
+			return nil
+		}
+		flags[hash] |= flag
+
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving commit %s", hash)
+			return err
+		}
+		heap.Push(q, c)
+		return nil
+	}
+
+	if err := mark(tip, walkFromTip); err != nil {
+		return err
+	}
+	if !seen.IsZero() {
+		if err := mark(seen, walkFromSeen); err != nil {
+			return err
+		}
+	}
+
+	var found []*object.Commit
+	slop := walkSlop
+	for q.Len() > 0 && slop > 0 {
+		c := heap.Pop(q).(*object.Commit)
+		flag := flags[c.Hash]
+		if flag == walkFromTip {
+			found = append(found, c)
+		}
+
+		for _, p := range c.ParentHashes {
+			if err := mark(p, flag); err != nil {
+				return err
+			}
+		}
+
+		if onlySeenLeft(*q, flags) {
+			slop--
+		} else {
+			slop = walkSlop
+		}
+	}
+
+	emitted := make(map[plumbing.Hash]bool)
+	for _, c := range found {
+		// Commit may turn out to be seen after it was found
+		if flags[c.Hash] != walkFromTip || emitted[c.Hash] {
+			continue
+		}
+		emitted[c.Hash] = true
+
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func onlySeenLeft(q commitQueue, flags map[plumbing.Hash]int) bool {
+	for _, c := range q {
+		if flags[c.Hash] == walkFromTip {
+			return false
+		}
+	}
+	return true
+}
+
+// countMsgs returns the number of messages of the checked out branch
+func countMsgs(r *git.Repository) (int, error) {
+	ref, err := r.Head()
 	if err != nil {
-		appConfig.LogErr(err, "retrieving worktree")
+		appConfig.LogErr(err, "retrieving HEAD")
 		return 0, err
 	}
 
-	err = w.Pull(opt)
-	if (err != nil) && (err != git.NoErrAlreadyUpToDate) {
-		appConfig.LogErr(err, "pulling messages")
+	n := 0
+	err = walkNewCommits(r, ref.Hash(), plumbing.ZeroHash, func(c *object.Commit) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// pullMsgs fetches the branches and reactions along with the extra refs
+// in one go and moves the checked out branch to the remote one. Refs
+// gone from the remote are dropped, so a deleted topic is not found.
+// It returns the number of messages not reachable from the seen commit,
+// e.g. HEAD before the pull
+func pullMsgs(r *git.Repository, seen plumbing.Hash, opt *git.PullOptions, extra ...config.RefSpec) (int, error) {
+	// Pull the branch we are on, otherwise the remote HEAD would be
+	// merged into whatever topic is checked out
+	branch := opt.ReferenceName.Short()
+	if opt.ReferenceName == "" {
+		curr, err := getCurrBranch(r)
+		if err != nil {
+			return 0, err
+		}
+		branch = curr
+	}
+
+	// My pending messages seen already get new hashes, when they are put
+	// after the pulled ones. They are not new messages though
+	seenPending := make(map[string]bool)
+	if !seen.IsZero() {
+		pending, err := outboxCommits(r)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range pending {
+			if id := msgFromCommit(c).MsgId; id != "" {
+				seenPending[id] = true
+			}
+		}
+	}
+
+	specs := []config.RefSpec{
+		config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, opt.RemoteName)),
+		reactionsRefSpec(),
+	}
+	err := fetch(r, &git.FetchOptions{
+		RemoteName: opt.RemoteName,
+		RefSpecs:   append(specs, extra...),
+		Auth:       opt.Auth,
+		Prune:      true,
+	})
+	if err != nil {
 		return 0, err
 	}
 
-	cIter, err := r.Log(&git.LogOptions{Since: since})
+	// My messages, which are not pushed yet, go after the pulled ones
+	_, err = rebaseOnRemote(r, branch)
 	if err != nil {
-		appConfig.LogErr(err, "retrieving log")
 		return 0, err
 	}
 
-	newMsg := 0
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return 0, err
+	}
 
-	err = cIter.ForEach(func(c *object.Commit) error {
-		newMsg += 1
+	newMsg := 0
+	err = walkNewCommits(r, ref.Hash(), seen, func(c *object.Commit) error {
+		if !seenPending[msgFromCommit(c).MsgId] {
+			newMsg += 1
+		}
 		return nil
 	})
 	if err != nil {
-		appConfig.LogErr(err, "iterating over log")
 		return 0, err
 	}
 
-	// Log counts also this commit, so remove it
-	if since != nil {
-		newMsg--
-	}
-
 	return newMsg, nil
 }
 
@@ -607,13 +1136,40 @@ func addCredentialsToLocalFile(chatName string, auth http.BasicAuth) error {
 		return err
 	}
 	defer credsFile.Close()
-	if _, err := credsFile.WriteString(chatName + credsFileDelim + auth.Password); err != nil {
+	if _, err := credsFile.WriteString(chatName + credsFileDelim + auth.Password + "\n"); err != nil {
 		appConfig.LogErr(err, "failed to write creds to %s", credsFilePath)
 		return err
 	}
 	return nil
 }
 
+func removeCredentialsFromLocalFile(chatName string) error {
+	credsFilePath := filepath.Join(chatDir, credsFileName)
+	data, err := os.ReadFile(credsFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		appConfig.LogErr(err, "failed to read %s to remove creds", credsFilePath)
+		return err
+	}
+
+	var kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		slice := strings.SplitN(line, credsFileDelim, 2)
+		if line != "" && slice[0] != chatName {
+			kept = append(kept, line+"\n")
+		}
+	}
+
+	err = os.WriteFile(credsFilePath, []byte(strings.Join(kept, "")), 0644)
+	if err != nil {
+		appConfig.LogErr(err, "failed to write %s to remove creds", credsFilePath)
+		return err
+	}
+	return nil
+}
+
 func CollectChats() ([]Chat, error) {
 	repos, _ := os.ReadDir(chatDir)
 	for _, r := range repos {
@@ -646,12 +1202,32 @@ func CollectChats() ([]Chat, error) {
 					auth = getCredentialsFromLocalFile(chatName)
 				}
 
-				msgNum, err := pullMsgs(repo, nil,
+				mainBranch, err := getMainBranch(repo)
+				if err != nil {
+					return nil, err
+				}
+
+				// Topics are chosen per session, so always start from the main chat
+				err = checkoutBranch(repo, mainBranch)
+				if err != nil {
+					return nil, err
+				}
+
+				msgNum, err := pullMsgs(repo, plumbing.ZeroHash,
 					&git.PullOptions{RemoteName: "origin", Auth: auth})
+				if isUnreachable(err) {
+					// Chat is read from the clone until the server is back
+					msgNum, err = countMsgs(repo)
+				}
 				if err != nil {
 					return nil, err
 				}
 
+				// Members may have changed while I was away
+				if pulled, err := mainChatInfo(repo); err == nil {
+					info = pulled
+				}
+
 				lastMsg, err := getLastMsg(repo)
 				if err != nil {
 					return nil, err
@@ -665,12 +1241,24 @@ func CollectChats() ([]Chat, error) {
 					basicAuth = *b
 				}
 
-				chat := newChat(info, msgNum, lastMsg, basicAuth.Username, basicAuth.Password)
-				Chats = append(Chats, chat)
+				unread, lastRead, err := countUnread(repo)
+				if err != nil {
+					return nil, err
+				}
+
+				chat := newChat(info, msgNum, lastMsg, mainBranch, basicAuth.Username, basicAuth.Password)
+				chat.NonReadMsgNum = unread
+				chat.LastRead = lastRead.String()
+				addToChats(&chat)
 			}
 		}
 	}
-	return Chats, nil
+
+	var chats []Chat
+	for _, c := range listChats() {
+		chats = append(chats, *c)
+	}
+	return chats, nil
 }
 
 func hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
@@ -746,13 +1334,17 @@ func addEmptyChat(chatUrl string) (*git.Repository, error) {
 		return nil, err
 	}
 
-	branch := "master"
+	branch := defaultMainBranch
 
-	if err = repo.CreateBranch(&config.Branch{Name: branch, Remote: git.DefaultRemoteName, Merge: plumbing.Master}); err != nil {
+	if err = repo.CreateBranch(&config.Branch{Name: branch, Remote: git.DefaultRemoteName, Merge: plumbing.NewBranchReferenceName(branch)}); err != nil {
 		appConfig.LogErr(err, "failed to create branch %s", branch)
 		return nil, err
 	}
 
+	if err = setMainBranch(repo, branch); err != nil {
+		return nil, err
+	}
+
 	return repo, nil
 }
 
@@ -812,6 +1404,11 @@ func AddChat(chatUrl, username, password string) (Chat, error) {
 	}
 
 	appConfig.LogDebug("Clone repo %s", chatPath)
+	mainBranch, err := getMainBranch(repo)
+	if err != nil {
+		return Chat{}, err
+	}
+
 	info, err := collectChatInfo(chatPath)
 	var e *os.PathError
 	switch {
@@ -831,18 +1428,24 @@ func AddChat(chatUrl, username, password string) (Chat, error) {
 		return Chat{}, err
 	}
 
+	// Members are trusted as far as their changes are allowed
+	if checked, err := mainChatInfo(repo); err == nil {
+		info = checked
+	}
+
 	inMembers, err := foundMeInMembers(info.Members)
 	if err != nil {
 		return Chat{}, err
 	}
 
 	if !inMembers {
-		info.Members, err = addMeToMembers(info.Members)
+		base := cloneChatInfo(info)
+		info.Members, err = addMeToMembers(info.Members, RoleMember)
 		if err != nil {
 			return Chat{}, err
 		}
 		info.MembersNum = len(info.Members)
-		err = updateChatInfo(repo, info, auth)
+		info, err = updateChatInfo(repo, base, info, auth)
 		if err != nil {
 			return Chat{}, err
 		}
@@ -863,7 +1466,7 @@ func AddChat(chatUrl, username, password string) (Chat, error) {
 		}
 	}
 
-	msgNum, err := pullMsgs(repo, nil,
+	msgNum, err := pullMsgs(repo, plumbing.ZeroHash,
 		&git.PullOptions{RemoteName: "origin", Auth: auth})
 	if err != nil {
 		return Chat{}, err
@@ -874,45 +1477,162 @@ func AddChat(chatUrl, username, password string) (Chat, error) {
 		return Chat{}, err
 	}
 
-	chat := newChat(info, msgNum, lastMsg, basicAuth.Username, basicAuth.Password)
-	Chats = append(Chats, chat)
+	// History of the chat I just joined is not news to me
+	lastRead, err := markRead(repo)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	chat := newChat(info, msgNum, lastMsg, mainBranch, basicAuth.Username, basicAuth.Password)
+	chat.LastRead = lastRead.String()
+	addToChats(&chat)
 
 	return chat, nil
 }
 
+// removeMeFromChat takes me out of members of the chat and publishes it
+func removeMeFromChat(r *git.Repository, c *Chat, auth transport.AuthMethod) error {
+	// Members are kept in the main chat
+	err := checkoutBranch(r, c.mainBranch)
+	if err != nil {
+		return err
+	}
+
+	_, err = pullMsgs(r, plumbing.ZeroHash, &git.PullOptions{RemoteName: "origin", Auth: auth})
+	if err != nil {
+		return err
+	}
+
+	info, err := mainChatInfo(r)
+	if err != nil {
+		return err
+	}
+
+	username, err := GetUserName()
+	if err != nil {
+		return err
+	}
+
+	// Roles are written down, as the first member left may be
+	// the owner only because of being the first
+	var members []chatMember
+	for _, m := range info.Members {
+		if m.Username != username {
+			m.Role = memberRole(info.Members, m.Username)
+			members = append(members, m)
+		}
+	}
+	if len(members) == len(info.Members) {
+		return nil
+	}
+
+	base := cloneChatInfo(info)
+	info.Members = members
+	info.MembersNum = len(members)
+	_, err = updateChatInfo(r, base, info, auth)
+	return err
+}
+
+// LeaveChat deletes the local clone of the chat along with its credentials.
+// With removeMe I am also taken out of the chat members, so the others
+// see I left. The chat has to be added again to come back
+func LeaveChat(chat Chat, removeMe bool) error {
+	c := findChatInList(chat)
+	if c == nil {
+		appConfig.LogErr(ErrNoMatchChatName, "leaving %s", chat.Name)
+		return ErrNoMatchChatName
+	}
+
+	err := func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		chatPath, err := getChatPath(c.Url.Path)
+		if err != nil {
+			return err
+		}
+
+		chatName, err := getChatName(c.Url.Path)
+		if err != nil {
+			return err
+		}
+
+		if removeMe {
+			repo, err := openChatRepo(c)
+			if err != nil {
+				return err
+			}
+
+			auth, err := getAuth(c.username, c.password)
+			if err != nil {
+				return err
+			}
+
+			err = removeMeFromChat(repo, c, auth)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.RemoveAll(chatPath)
+		if err != nil {
+			appConfig.LogErr(err, "removing %s", chatPath)
+			return err
+		}
+		// Owner directory is removed once its last chat is gone
+		os.Remove(filepath.Dir(chatPath))
+
+		err = removeCredentialsFromLocalFile(chatName)
+		if err != nil {
+			return err
+		}
+		appConfig.LogDebug("Leave chat %s", c.Name)
+
+		// Polling skips the chat once it is out of the list
+		dropFromChats(c)
+		return nil
+	}()
+	return err
+}
+
 func findChatInList(chat Chat) *Chat {
-	for idx := range Chats {
-		if Chats[idx].Name == chat.Name {
-			return &Chats[idx]
+	chatsMu.Lock()
+	defer chatsMu.Unlock()
+	for _, c := range Chats {
+		if c.Name == chat.Name {
+			return c
 		}
 	}
 	return nil
 }
 
-func getMsgs(r *git.Repository, since *time.Time) ([]Message, error) {
-	cIter, err := r.Log(&git.LogOptions{Since: since})
+// getMsgs returns the messages not reachable from the seen commit,
+// the most recent first
+func getMsgs(r *git.Repository, seen plumbing.Hash) ([]Message, error) {
+	ref, err := r.Head()
 	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
 		return nil, err
 	}
 
+	// Merged topics bring their own history, which is ordered by time
+	// to keep their messages in place
 	var msgs []Message
-	err = cIter.ForEach(func(c *object.Commit) error {
-		m := Message{
-			Text:   strings.TrimSuffix(c.Message, "\n"),
-			Author: c.Author.Name,
-			Time:   c.Author.When,
-		}
-		msgs = append(msgs, m)
+	err = walkNewCommits(r, ref.Hash(), seen, func(c *object.Commit) error {
+		msgs = append(msgs, msgFromCommit(c))
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Log counts also this commit, so remove it
-	if since != nil {
-		msgs = msgs[:len(msgs)-1]
-	}
+	msgs = foldMsgs(msgs, moderators(r), func(hash string) (Message, error) {
+		return loadMsg(r, hash)
+	})
+	addReactions(r, msgs)
+	addReceipts(r, msgs)
+	addPending(r, msgs)
+	addSignatures(r, msgs)
 	return msgs, nil
 }
 
@@ -924,15 +1644,16 @@ func printMsgs(msgs []Message) {
 	}
 }
 
+// SelectChat makes the chat current and pulls its messages. Load them
+// with GetLatestMsgs and older ones page by page with GetMsgsBefore
 func SelectChat(chat Chat) (Chat, error) {
 	if c := findChatInList(chat); c != nil {
-		currChat = c
-		var msgs []Message
+		setCurrChat(c)
 		err := func() error {
-			currChat.mu.Lock()
-			defer currChat.mu.Unlock()
+			c.mu.Lock()
+			defer c.mu.Unlock()
 
-			chatPath, err := getChatPath(currChat.Url.Path)
+			chatPath, err := getChatPath(c.Url.Path)
 			if err != nil {
 				return err
 			}
@@ -943,53 +1664,82 @@ func SelectChat(chat Chat) (Chat, error) {
 				return err
 			}
 
-			auth, err := getAuth(currChat.username, currChat.password)
+			auth, err := getAuth(c.username, c.password)
 			if err != nil {
 				return err
 			}
 
-			msgNum, err := pullMsgs(repo, nil,
+			msgNum, err := pullMsgs(repo, plumbing.ZeroHash,
 				&git.PullOptions{RemoteName: "origin", Auth: auth})
+			if isUnreachable(err) {
+				// Chat is read from the clone until the server is back
+				msgNum, err = countMsgs(repo)
+			}
 			if err != nil {
 				return err
 			}
 
-			currChat.MsgNum = msgNum
-			currChat.NonReadMsgNum = 0
+			c.MsgNum = msgNum
 
-			msgs, err = getMsgs(repo, nil)
-			return err
+			unread, lastRead, err := countUnread(repo)
+			if err != nil {
+				return err
+			}
+			c.NonReadMsgNum = unread
+			c.LastRead = lastRead.String()
+			c.Presence = getPresence(repo)
+
+			// Roles are enforced with the members, so they should be fresh
+			if info, err := mainChatInfo(repo); err == nil {
+				c.Members = info.Members
+				c.MembersNum = info.MembersNum
+			}
+			return nil
 		}()
 		if err != nil {
 			return Chat{}, err
 		}
-		go func() {
-			printMsgs(msgs)
-		}()
-		return *currChat, nil
+		return *c, nil
 	}
 	return Chat{}, fmt.Errorf("chat %s not found", chat.Name)
 }
 
 func SendMsg(text string) (Chat, error) {
-	if currChat == nil {
+	return sendMsg(nil, text)
+}
+
+// SendReply sends the message as a reply to the message with replyTo hash
+func SendReply(text string, replyTo string) (Chat, error) {
+	return sendMsg(nil, text, trailer{trailerReplyTo, replyTo})
+}
+
+// sendMsg commits the message with the attachment, if any, and pushes it
+// to the current chat
+func sendMsg(att *attachment, text string, trailers ...trailer) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
 		return Chat{}, ErrCurrChatNil
 	}
 
-	auth, err := getAuth(currChat.username, currChat.password)
+	auth, err := getAuth(chat.username, chat.password)
 	if err != nil {
 		return Chat{}, err
 	}
 
+	var sent []Message
 	err = func() error {
-		currChat.mu.Lock()
-		defer currChat.mu.Unlock()
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
 
-		if currChat.Url == nil {
+		if chat.Url == nil {
 			return errors.New("missing url")
 		}
 
-		chatPath, err := getChatPath(currChat.Url.Path)
+		if err := checkPermission(chat, PermWrite); err != nil {
+			return err
+		}
+
+		chatPath, err := getChatPath(chat.Url.Path)
 		if err != nil {
 			return err
 		}
@@ -1000,35 +1750,87 @@ func SendMsg(text string) (Chat, error) {
 			return err
 		}
 
-		msgNum, err := pullMsgs(repo, nil,
+		// Without the server the message goes to the outbox
+		msgNum, err := pullMsgs(repo, plumbing.ZeroHash,
 			&git.PullOptions{RemoteName: "origin", Auth: auth})
-		if err != nil {
+		switch {
+		case isUnreachable(err):
+			appConfig.LogDebug("%s is unreachable", chat.Name)
+		case err != nil:
 			return err
+		default:
+			chat.MsgNum = msgNum
+		}
+
+		fileName := ""
+		if att != nil {
+			fileName, err = writeAttachment(repo, att)
+			if err != nil {
+				return err
+			}
+			trailers = append(trailers, trailer{trailerAttachment, fileName})
 		}
 
-		currChat.MsgNum = msgNum
+		msgId := newMsgId()
+		trailers = append(trailers, trailer{trailerMsgId, msgId})
+		err = commit(repo, fileName, withTrailers(commitText(text), trailers...))
+		if err != nil {
+			dropAttachment(repo, fileName)
+			return err
+		}
 
-		err = commit(repo, "", text)
+		branch, err := getCurrBranch(repo)
 		if err != nil {
 			return err
 		}
 
-		err = push(repo, &git.PushOptions{Auth: auth})
+		// Somebody may have sent a message in between, so mine are
+		// put after theirs and pushed again
+		// Only the server being away keeps the message in the outbox.
+		// Otherwise it is dropped, so sending it again makes no duplicate
+		rebased, err := pushPending(repo, branch, auth)
 		switch {
+		case isUnreachable(err), errors.Is(err, ErrPushRejected):
+			appConfig.LogDebug("Keep msg %s in outbox of %s", text, chat.Name)
 		case errors.Is(err, transport.ErrAuthenticationRequired):
-			appConfig.LogErr(err, "authentication required for %s", currChat.Url.Path)
+			appConfig.LogErr(err, "authentication required for %s", chat.Url.Path)
+			dropMsg(repo, msgId)
 			return ErrAuthenticationRequired
 		case err != nil:
-			appConfig.LogErr(err, "failed to push %s", currChat.Url.Path)
+			appConfig.LogErr(err, "failed to push %s", chat.Url.Path)
+			dropMsg(repo, msgId)
+			return err
+		}
+		appConfig.LogDebug("Send msg %s to %s", text, chat.Name)
+
+		chat.MsgNum += 1
+		if rebased {
+			chat.MsgNum, err = countMsgs(repo)
+			if err != nil {
+				return err
+			}
+		}
+		chat.NonReadMsgNum = 0
+
+		// My own message reads the dialogue up to it
+		lastRead, err := markRead(repo)
+		if err != nil {
 			return err
 		}
-		appConfig.LogDebug("Send msg %s to %s", text, currChat.Name)
+		chat.LastRead = lastRead.String()
+		pushReceipt(repo, auth)
 
-		currChat.MsgNum += 1
-		currChat.NonReadMsgNum = 0
+		chat.LastMsg, err = getLastMsg(repo)
+		if err != nil {
+			return err
+		}
 
-		currChat.LastMsg, err = getLastMsg(repo)
-		return err
+		sent = foldMsgs([]Message{chat.LastMsg}, moderators(repo), func(hash string) (Message, error) {
+			return loadMsg(repo, hash)
+		})
+		addPending(repo, sent)
+		addSignatures(repo, sent)
+		return nil
 	}()
 
 	if err != nil {
@@ -1036,24 +1838,67 @@ func SendMsg(text string) (Chat, error) {
 	}
 
 	go func() {
-		printMsgs([]Message{currChat.LastMsg})
+		printMsgs(sent)
 	}()
 
-	return *currChat, nil
+	return *chat, nil
+}
+
+// GetMsg returns the message of the current chat by its commit hash
+func GetMsg(hash string) (Message, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Message{}, ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return loadMsg(repo, hash)
 }
 
+// ClearNonReadMsgsForCurrChat marks the dialogue of the current chat
+// as read, so the unread count survives restarts
 func ClearNonReadMsgsForCurrChat() (Chat, error) {
-	if currChat == nil {
-		appConfig.LogErr(ErrCurrChatNil, "currChat is nil")
+	chat := getCurrChat()
+	if chat == nil {
+		appConfig.LogErr(ErrCurrChatNil, "chat is nil")
 		return Chat{}, ErrCurrChatNil
 	}
-	currChat.NonReadMsgNum = 0
-	return *currChat, nil
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	lastRead, err := markRead(repo)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	auth, err := getAuth(chat.username, chat.password)
+	if err != nil {
+		return Chat{}, err
+	}
+	pushReceipt(repo, auth)
+
+	chat.NonReadMsgNum = 0
+	chat.LastRead = lastRead.String()
+	return *chat, nil
 }
 
 func GetCurrChat() (Chat, error) {
-	if currChat == nil {
+	chat := getCurrChat()
+	if chat == nil {
 		return Chat{}, ErrCurrChatNil
 	}
-	return *currChat, nil
+	return *chat, nil
 }
@@ -1,13 +1,30 @@
 package client
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const testDir string = "/tmp/client-test"
@@ -50,6 +67,177 @@ func teardownTest(t *testing.T) {
 	os.RemoveAll(testDir)
 }
 
+// msgChannOnce makes the channel once, printing goroutines of the earlier
+// tests may still send to it
+var msgChannOnce sync.Once
+
+// setupLocalChats creates n empty chats as bare repos served over file://
+// and returns their urls. become makes the client work as the user, each
+// with its own home and clones
+func setupLocalChats(t *testing.T, n int) ([]string, func(username string)) {
+	root := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		Chats = nil
+		currChat = nil
+	})
+	msgChannOnce.Do(func() {
+		// Messages printed in the background are not checked, nobody
+		// reads them but the channel must not fill up
+		msgChann = make(chan Message)
+		go func() {
+			for range msgChann {
+			}
+		}()
+	})
+
+	var urls []string
+	for i := 0; i < n; i++ {
+		srv := filepath.Join(root, "srv", "owner", fmt.Sprintf("chat%d.git", i))
+		if _, err := git.PlainInit(srv, true); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, "file://"+srv)
+	}
+
+	become := func(username string) {
+		home := filepath.Join(root, "home-"+username)
+		if err := os.MkdirAll(home, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		gitConfig := fmt.Sprintf("[user]\n\tname = %s\n\temail = %s@example.com\n", username, username)
+		if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitConfig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("HOME", home)
+		if err := os.Chdir(home); err != nil {
+			t.Fatal(err)
+		}
+		Chats = nil
+		currChat = nil
+	}
+	return urls, become
+}
+
+// remoteChatInfo reads info.json from the main branch of the chat server
+func remoteChatInfo(t *testing.T, url string) ChatInfoJson {
+	r, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := mainChatInfo(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// remoteMsgs returns texts of the messages on the main branch
+// of the chat server, the most recent first
+func remoteMsgs(t *testing.T, url string) []string {
+	r, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	for hash := head.Hash(); !hash.IsZero(); {
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, msgFromCommit(c).Text)
+		hash = plumbing.ZeroHash
+		if c.NumParents() > 0 {
+			hash = c.ParentHashes[0]
+		}
+	}
+	return texts
+}
+
+// pushMsgAs pushes the message to the main branch of the chat server
+// the way another client of the author would
+func pushMsgAs(t *testing.T, url, author, text string) {
+	r, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := r.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := object.Signature{Name: author, Email: author + "@example.com", When: time.Now()}
+	c := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      text,
+		TreeHash:     parent.TreeHash,
+		ParentHashes: []plumbing.Hash{parent.Hash},
+	}
+	obj := r.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// goOffline points the current chat to a server, which cannot be reached,
+// and returns the function bringing it back
+func goOffline(t *testing.T) func() {
+	repo, err := openChatRepo(currChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := cfg.Remotes[git.DefaultRemoteName]
+	urls := remote.URLs
+	remote.URLs = []string{"http://127.0.0.1:1/owner/chat.git"}
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		remote.URLs = urls
+		if err := repo.SetConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func memberNames(members []chatMember) []string {
+	var names []string
+	for _, m := range members {
+		names = append(names, m.Username)
+	}
+	return names
+}
+
 func TestAddChat(t *testing.T) {
 	defer teardownTest(t)
 
@@ -121,3 +309,1891 @@ func TestAddChat(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTrailers(t *testing.T) {
+	subtests := []struct {
+		name         string
+		giveMsg      string
+		wantText     string
+		wantTrailers map[string]string
+	}{
+		{
+			name:         "Test plain message",
+			giveMsg:      "hello\n",
+			wantText:     "hello",
+			wantTrailers: nil,
+		}, {
+			name:         "Test merged topic",
+			giveMsg:      "Merge topic design\n\nSummary\n\nTopic-Merged: design\n",
+			wantText:     "Merge topic design\n\nSummary",
+			wantTrailers: map[string]string{"Topic-Merged": "design"},
+		}, {
+			name:         "Test reply",
+			giveMsg:      "sure\n\nReply-To: 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n",
+			wantText:     "sure",
+			wantTrailers: map[string]string{"Reply-To": "4b825dc642cb6eb9a060e54bf8d69288fbee4904"},
+		}, {
+			name:         "Test unknown trailer is kept in text",
+			giveMsg:      "hello\n\nNote: it is not a trailer",
+			wantText:     "hello\n\nNote: it is not a trailer",
+			wantTrailers: nil,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, trailers := parseTrailers(tt.giveMsg)
+			assert.Equal(t, tt.wantText, text)
+			assert.Equal(t, tt.wantTrailers, trailers)
+		})
+	}
+}
+
+func TestFoldMsgs(t *testing.T) {
+	resolve := func(hash string) (Message, error) {
+		return Message{}, errors.New("not found")
+	}
+
+	subtests := []struct {
+		name      string
+		giveMsgs  []Message
+		giveMods  map[string]bool
+		wantTexts []string
+	}{
+		{
+			name: "Test edit is folded",
+			giveMsgs: []Message{
+				{Text: "hello", Author: "alice", Hash: "2", Edits: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			wantTexts: []string{"hello"},
+		}, {
+			name: "Test edit by other author is skipped",
+			giveMsgs: []Message{
+				{Text: "hacked", Author: "bob", Hash: "2", Edits: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			wantTexts: []string{"helo"},
+		}, {
+			name: "Test edit of unknown message is dropped",
+			giveMsgs: []Message{
+				{Text: "hello", Author: "alice", Hash: "2", Edits: "0"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			wantTexts: []string{"helo"},
+		}, {
+			name: "Test retract hides text",
+			giveMsgs: []Message{
+				{Text: "Message deleted", Author: "alice", Hash: "3", Retracts: "1"},
+				{Text: "hello", Author: "alice", Hash: "2", Edits: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			wantTexts: []string{""},
+		}, {
+			name: "Test retract by other author is skipped",
+			giveMsgs: []Message{
+				{Text: "Message deleted", Author: "bob", Hash: "2", Retracts: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			wantTexts: []string{"helo"},
+		}, {
+			name: "Test message sent twice is shown once",
+			giveMsgs: []Message{
+				{Text: "hello", Author: "alice", Hash: "2", MsgId: "a1"},
+				{Text: "hello", Author: "alice", Hash: "1", MsgId: "a1"},
+			},
+			wantTexts: []string{"hello"},
+		}, {
+			name: "Test retract by moderator hides text",
+			giveMsgs: []Message{
+				{Text: "Message deleted", Author: "bob", Hash: "2", Retracts: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			giveMods:  map[string]bool{"bob": true},
+			wantTexts: []string{""},
+		}, {
+			name: "Test edit by moderator is skipped",
+			giveMsgs: []Message{
+				{Text: "hacked", Author: "bob", Hash: "2", Edits: "1"},
+				{Text: "helo", Author: "alice", Hash: "1"},
+			},
+			giveMods:  map[string]bool{"bob": true},
+			wantTexts: []string{"helo"},
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			var texts []string
+			for _, m := range foldMsgs(tt.giveMsgs, tt.giveMods, resolve) {
+				texts = append(texts, m.Text)
+			}
+			assert.Equal(t, tt.wantTexts, texts)
+		})
+	}
+}
+
+func TestParseReactions(t *testing.T) {
+	subtests := []struct {
+		name          string
+		giveNote      string
+		wantReactions map[string]string
+	}{
+		{
+			name:          "Test empty note",
+			giveNote:      "",
+			wantReactions: map[string]string{},
+		}, {
+			name:          "Test username with spaces",
+			giveNote:      "👍 alice\n🎉 John Doe\n",
+			wantReactions: map[string]string{"alice": "👍", "John Doe": "🎉"},
+		}, {
+			name:          "Test broken line is skipped",
+			giveNote:      "👍\n❤️ bob\n",
+			wantReactions: map[string]string{"bob": "❤️"},
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			reactions := parseReactions(tt.giveNote)
+			assert.Equal(t, tt.wantReactions, reactions)
+			assert.Equal(t, reactions, parseReactions(formatReactions(reactions)))
+		})
+	}
+}
+
+func TestCommitText(t *testing.T) {
+	subtests := []struct {
+		name       string
+		giveText   string
+		wantCommit string
+	}{
+		{
+			name:       "Test single line",
+			giveText:   "hello",
+			wantCommit: "hello",
+		}, {
+			name:       "Test multiple lines",
+			giveText:   "hello\nfunc main() {\n}",
+			wantCommit: "hello\n\nfunc main() {\n}",
+		}, {
+			name:       "Test blank second line",
+			giveText:   "hello\n\nworld",
+			wantCommit: "hello\n\n\nworld",
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			commit := commitText(tt.giveText)
+			assert.Equal(t, tt.wantCommit, commit)
+			assert.Equal(t, tt.giveText, msgText(commit))
+		})
+	}
+}
+
+func TestSearchQueryMatch(t *testing.T) {
+	msg := Message{
+		Text:   "Release notes\nWe deploy on Friday after the review",
+		Author: "alice",
+		Time:   time.Date(2024, 9, 15, 12, 0, 0, 0, time.Local),
+	}
+
+	subtests := []struct {
+		name        string
+		giveQuery   string
+		wantMatch   bool
+		wantContext string
+	}{
+		{
+			name:        "Test regexp in body",
+			giveQuery:   "deploy|ship",
+			wantMatch:   true,
+			wantContext: "We deploy on Friday after the review",
+		}, {
+			name:        "Test author",
+			giveQuery:   "author:Alice release",
+			wantMatch:   true,
+			wantContext: "Release notes",
+		}, {
+			name:        "Test other author",
+			giveQuery:   "author:bob release",
+			wantMatch:   false,
+			wantContext: "",
+		}, {
+			name:        "Test dates",
+			giveQuery:   "after:2024-09-15 before:16.09.2024",
+			wantMatch:   true,
+			wantContext: "Release notes",
+		}, {
+			name:        "Test before",
+			giveQuery:   "before:2024-09-15",
+			wantMatch:   false,
+			wantContext: "",
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseSearchQuery(tt.giveQuery)
+			assert.NoError(t, err)
+			context, ok := q.match(msg)
+			assert.Equal(t, tt.wantMatch, ok)
+			assert.Equal(t, tt.wantContext, context)
+		})
+	}
+}
+
+// testCommit writes the commit of alice made the minutes after
+// the same start and returns its hash
+func testCommit(t *testing.T, r *git.Repository, msg string, minutes int, parents ...plumbing.Hash) plumbing.Hash {
+	start := time.Date(2024, 9, 15, 12, 0, 0, 0, time.UTC)
+	sig := object.Signature{Name: "alice", When: start.Add(time.Duration(minutes) * time.Minute)}
+	c := &object.Commit{Author: sig, Committer: sig, Message: msg, TreeHash: plumbing.ZeroHash, ParentHashes: parents}
+
+	obj := r.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// testHistory writes n commits m0, m1, ... one after another
+func testHistory(t *testing.T, r *git.Repository, n int) []plumbing.Hash {
+	var commits []plumbing.Hash
+	for i := 0; i < n; i++ {
+		var parents []plumbing.Hash
+		if i > 0 {
+			parents = []plumbing.Hash{commits[i-1]}
+		}
+		commits = append(commits, testCommit(t, r, fmt.Sprintf("m%d", i), i, parents...))
+	}
+	return commits
+}
+
+func TestWalkNewCommits(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := make(map[string]plumbing.Hash)
+	add := func(name string, minutes int, parents ...string) {
+		var hashes []plumbing.Hash
+		for _, p := range parents {
+			hashes = append(hashes, commits[p])
+		}
+		commits[name] = testCommit(t, r, name, minutes, hashes...)
+	}
+
+	// Topic t1..t2 is forked from m1 and merged after m2, m3 has a skewed clock
+	add("m0", 0)
+	add("m1", 1, "m0")
+	add("t1", 2, "m1")
+	add("t2", 3, "t1")
+	add("m2", 4, "m1")
+	add("merge", 5, "m2", "t2")
+	add("m3", -60, "merge")
+	add("m4", 7, "m3")
+
+	subtests := []struct {
+		name      string
+		giveTip   string
+		giveSeen  string
+		wantNames []string
+	}{
+		{
+			name:      "Test whole history",
+			giveTip:   "m2",
+			giveSeen:  "",
+			wantNames: []string{"m2", "m1", "m0"},
+		}, {
+			name:      "Test merged topic",
+			giveTip:   "merge",
+			giveSeen:  "m2",
+			wantNames: []string{"merge", "t2", "t1"},
+		}, {
+			name:      "Test skewed clock",
+			giveTip:   "m4",
+			giveSeen:  "m2",
+			wantNames: []string{"m4", "m3", "merge", "t2", "t1"},
+		}, {
+			name:      "Test nothing new",
+			giveTip:   "m2",
+			giveSeen:  "m2",
+			wantNames: nil,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := plumbing.ZeroHash
+			if tt.giveSeen != "" {
+				seen = commits[tt.giveSeen]
+			}
+
+			var names []string
+			err := walkNewCommits(r, commits[tt.giveTip], seen, func(c *object.Commit) error {
+				names = append(names, c.Message)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantNames, names)
+		})
+	}
+}
+
+func TestCountUnread(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := testHistory(t, r, 3)
+
+	setHead := func(hash plumbing.Hash) {
+		err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The branch never read before is read up to HEAD
+	setHead(commits[0])
+	unread, lastRead, err := countUnread(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, unread)
+	assert.Equal(t, commits[0], lastRead)
+
+	setHead(commits[2])
+	unread, lastRead, err = countUnread(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, unread)
+	assert.Equal(t, commits[0], lastRead)
+
+	lastRead, err = markRead(r)
+	assert.NoError(t, err)
+	assert.Equal(t, commits[2], lastRead)
+
+	unread, _, err = countUnread(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, unread)
+}
+
+func TestMemberRefName(t *testing.T) {
+	subtests := []struct {
+		name         string
+		giveUsername string
+		wantRef      plumbing.ReferenceName
+	}{
+		{
+			name:         "Test plain username",
+			giveUsername: "alice_1",
+			wantRef:      "refs/gitogram/read/alice_1",
+		}, {
+			name:         "Test username with space",
+			giveUsername: "Alice Smith",
+			wantRef:      "refs/gitogram/read/Alice%20Smith",
+		}, {
+			name:         "Test username with dots and slash",
+			giveUsername: "a..b/c.lock",
+			wantRef:      "refs/gitogram/read/a%2E%2Eb%2Fc%2Elock",
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := memberRefName(receiptsRefPrefix, tt.giveUsername)
+			assert.Equal(t, tt.wantRef, ref)
+
+			username, ok := refMember(receiptsRefPrefix, ref)
+			assert.True(t, ok)
+			assert.Equal(t, tt.giveUsername, username)
+		})
+	}
+}
+
+func TestReceiptPerBranch(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	_, err = SendMsg("hello")
+	assert.NoError(t, err)
+
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+	_, err = ClearNonReadMsgsForCurrChat()
+	assert.NoError(t, err)
+
+	_, err = CreateTopic("side")
+	assert.NoError(t, err)
+	_, err = SwitchTopic("side")
+	assert.NoError(t, err)
+	_, err = SendMsg("in topic")
+	assert.NoError(t, err)
+	_, err = ClearNonReadMsgsForCurrChat()
+	assert.NoError(t, err)
+
+	srv, err := git.PlainOpen(strings.TrimPrefix(urls[0], "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, branch := range []string{"master", "side"} {
+		tip, err := srv.Reference(plumbing.NewBranchReferenceName(branch), true)
+		assert.NoError(t, err)
+		receipt, err := srv.Reference(receiptRefName("bob", branch), true)
+		if assert.NoError(t, err, branch) {
+			assert.Equal(t, tip.Hash(), receipt.Hash(), branch)
+		}
+	}
+
+	// Reading the topic keeps the main chat read
+	_, err = SwitchTopic("")
+	assert.NoError(t, err)
+	repo, err := openChatRepo(currChat)
+	assert.NoError(t, err)
+	unseen := unseenCommits(repo)
+	if assert.Contains(t, unseen, "bob") {
+		assert.Empty(t, unseen["bob"])
+	}
+}
+
+func TestPullMsgs(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	_, err = SendMsg("hello")
+	assert.NoError(t, err)
+	_, err = ClearNonReadMsgsForCurrChat()
+	assert.NoError(t, err)
+	_, err = CreateTopic("side")
+	assert.NoError(t, err)
+
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+	repo, err := openChatRepo(currChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := &git.PullOptions{RemoteName: git.DefaultRemoteName}
+
+	// Receipts come only along with the extra refs
+	_, err = pullMsgs(repo, plumbing.ZeroHash, opt)
+	assert.NoError(t, err)
+	assert.NotContains(t, getReceipts(repo, "master"), "alice")
+	_, err = pullMsgs(repo, plumbing.ZeroHash, opt, receiptsRefSpec(), presenceRefSpec())
+	assert.NoError(t, err)
+	assert.Contains(t, getReceipts(repo, "master"), "alice")
+
+	// Topic deleted from the remote is not found
+	_, err = SwitchTopic("side")
+	assert.NoError(t, err)
+	srv, err := git.PlainOpen(strings.TrimPrefix(urls[0], "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Storer.RemoveReference(plumbing.NewBranchReferenceName("side"))
+	assert.NoError(t, err)
+	_, err = pullMsgs(repo, plumbing.ZeroHash, &git.PullOptions{RemoteName: git.DefaultRemoteName})
+	assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+}
+
+func TestPresenceState(t *testing.T) {
+	now := time.Date(2024, 9, 15, 12, 0, 0, 0, time.UTC)
+
+	subtests := []struct {
+		name          string
+		giveHeartbeat time.Time
+		giveActivity  time.Time
+		wantState     PresenceState
+	}{
+		{
+			name:          "Test active member",
+			giveHeartbeat: now.Add(-time.Minute),
+			giveActivity:  now.Add(-2 * time.Minute),
+			wantState:     PresenceOnline,
+		}, {
+			name:          "Test member away from keyboard",
+			giveHeartbeat: now.Add(-time.Minute),
+			giveActivity:  now.Add(-time.Hour),
+			wantState:     PresenceIdle,
+		}, {
+			name:          "Test closed app",
+			giveHeartbeat: now.Add(-10 * time.Minute),
+			giveActivity:  now.Add(-10 * time.Minute),
+			wantState:     PresenceOffline,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantState, presenceState(tt.giveHeartbeat, tt.giveActivity, now))
+		})
+	}
+}
+
+func TestDirectTopicName(t *testing.T) {
+	assert.Equal(t, "dm-alice-bob", DirectTopicName("bob", "alice"))
+	assert.Equal(t, DirectTopicName("alice", "bob"), DirectTopicName("bob", "alice"))
+	assert.Equal(t, "dm-Alice_Smith-bob.k", DirectTopicName("Alice Smith", "bob.k"))
+	assert.True(t, topicNameRe.MatchString(DirectTopicName("Алиса", "bob")))
+}
+
+func TestVisibleName(t *testing.T) {
+	chat := Chat{Members: []chatMember{
+		{Username: "alice", VisibleName: "Alice Smith"},
+		{Username: "bob"},
+	}}
+
+	assert.Equal(t, "Alice Smith", VisibleName(chat, "alice"))
+	assert.Equal(t, "bob", VisibleName(chat, "bob"))
+	assert.Equal(t, "carol", VisibleName(chat, "carol"))
+}
+
+func TestMemberRole(t *testing.T) {
+	subtests := []struct {
+		name     string
+		members  []chatMember
+		username string
+		wantRole Role
+	}{
+		{
+			name:     "Test role is read",
+			members:  []chatMember{{Username: "alice", Role: RoleOwner}, {Username: "bob", Role: RoleReadOnly}},
+			username: "bob",
+			wantRole: RoleReadOnly,
+		}, {
+			name:     "Test first member of old chat is owner",
+			members:  []chatMember{{Username: "alice"}, {Username: "bob"}},
+			username: "alice",
+			wantRole: RoleOwner,
+		}, {
+			name:     "Test other member of old chat is member",
+			members:  []chatMember{{Username: "alice"}, {Username: "bob"}},
+			username: "bob",
+			wantRole: RoleMember,
+		}, {
+			name:     "Test first member is not owner, if there is one",
+			members:  []chatMember{{Username: "alice"}, {Username: "bob", Role: RoleOwner}},
+			username: "alice",
+			wantRole: RoleMember,
+		}, {
+			name:     "Test not a member has no role",
+			members:  []chatMember{{Username: "alice", Role: RoleOwner}},
+			username: "carol",
+			wantRole: "",
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantRole, memberRole(tt.members, tt.username))
+		})
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	assert.True(t, RoleAllows(RoleReadOnly, PermRead))
+	assert.False(t, RoleAllows(RoleReadOnly, PermWrite))
+	assert.True(t, RoleAllows(RoleMember, PermWrite))
+	assert.False(t, RoleAllows(RoleMember, PermModerate))
+	assert.True(t, RoleAllows(RoleAdmin, PermModerate))
+	assert.True(t, RoleAllows(RoleOwner, PermModerate))
+	assert.False(t, RoleAllows("", PermWrite))
+
+	assert.True(t, canManage(RoleOwner, RoleAdmin))
+	assert.True(t, canManage(RoleAdmin, RoleMember))
+	assert.False(t, canManage(RoleAdmin, RoleAdmin))
+	assert.False(t, canManage(RoleMember, RoleReadOnly))
+}
+
+func TestAllowedInfoChange(t *testing.T) {
+	prev := ChatInfoJson{Name: "chat", Members: []chatMember{
+		{Username: "alice", VisibleName: "alice", Role: RoleOwner},
+		{Username: "bob", VisibleName: "bob", Role: RoleAdmin},
+		{Username: "carol", VisibleName: "carol", Role: RoleMember},
+		{Username: "dave", VisibleName: "dave", Role: RoleReadOnly},
+	}}
+
+	change := func(f func(info *ChatInfoJson)) ChatInfoJson {
+		info := cloneChatInfo(prev)
+		f(&info)
+		return info
+	}
+	setRole := func(username string, role Role) ChatInfoJson {
+		return change(func(info *ChatInfoJson) {
+			for i := range info.Members {
+				if info.Members[i].Username == username {
+					info.Members[i].Role = role
+				}
+			}
+		})
+	}
+	remove := func(username string) ChatInfoJson {
+		return change(func(info *ChatInfoJson) {
+			info.Members = slices.DeleteFunc(info.Members, func(m chatMember) bool {
+				return m.Username == username
+			})
+		})
+	}
+	join := func(username string, role Role) ChatInfoJson {
+		return change(func(info *ChatInfoJson) {
+			info.Members = append(info.Members, chatMember{Username: username, VisibleName: username, Role: role})
+		})
+	}
+
+	subtests := []struct {
+		name       string
+		giveNext   ChatInfoJson
+		giveAuthor string
+		want       bool
+	}{
+		{
+			name:       "Test owner promotes member to admin",
+			giveNext:   setRole("carol", RoleAdmin),
+			giveAuthor: "alice",
+			want:       true,
+		}, {
+			name:       "Test member promotes itself to owner",
+			giveNext:   setRole("carol", RoleOwner),
+			giveAuthor: "carol",
+			want:       false,
+		}, {
+			name:       "Test admin gives its own role",
+			giveNext:   setRole("carol", RoleAdmin),
+			giveAuthor: "bob",
+			want:       false,
+		}, {
+			name:       "Test admin demotes owner",
+			giveNext:   setRole("alice", RoleMember),
+			giveAuthor: "bob",
+			want:       false,
+		}, {
+			name:       "Test admin kicks member",
+			giveNext:   remove("carol"),
+			giveAuthor: "bob",
+			want:       true,
+		}, {
+			name:       "Test member kicks member",
+			giveNext:   remove("dave"),
+			giveAuthor: "carol",
+			want:       false,
+		}, {
+			name:       "Test read-only leaves",
+			giveNext:   remove("dave"),
+			giveAuthor: "dave",
+			want:       true,
+		}, {
+			name:       "Test newcomer joins as member",
+			giveNext:   join("erin", RoleMember),
+			giveAuthor: "erin",
+			want:       true,
+		}, {
+			name:       "Test newcomer joins as admin",
+			giveNext:   join("erin", RoleAdmin),
+			giveAuthor: "erin",
+			want:       false,
+		}, {
+			name:       "Test member adds somebody else",
+			giveNext:   join("erin", RoleMember),
+			giveAuthor: "carol",
+			want:       false,
+		}, {
+			name: "Test member renames itself",
+			giveNext: change(func(info *ChatInfoJson) {
+				info.Members[2].VisibleName = "Carol"
+			}),
+			giveAuthor: "carol",
+			want:       true,
+		}, {
+			name: "Test admin renames member",
+			giveNext: change(func(info *ChatInfoJson) {
+				info.Members[2].VisibleName = "Carol"
+			}),
+			giveAuthor: "bob",
+			want:       false,
+		}, {
+			name: "Test member renames chat",
+			giveNext: change(func(info *ChatInfoJson) {
+				info.Name = "renamed"
+			}),
+			giveAuthor: "carol",
+			want:       false,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, allowedInfoChange(prev, tt.giveNext, tt.giveAuthor))
+		})
+	}
+}
+
+func TestParseChatInfo(t *testing.T) {
+	subtests := []struct {
+		name        string
+		giveJson    string
+		wantVersion int
+		wantRoles   []Role
+		wantNames   []string
+	}{
+		{
+			name:        "Test chat without version is migrated",
+			giveJson:    `{"name":"me/chat","membersNum":1,"members":[{"Username":"alice"},{"Username":"bob"}]}`,
+			wantVersion: infoSchemaVersion,
+			wantRoles:   []Role{RoleOwner, RoleMember},
+			wantNames:   []string{"alice", "bob"},
+		}, {
+			name:        "Test chat of current version is kept",
+			giveJson:    `{"schemaVersion":1,"name":"me/chat","membersNum":2,"members":[{"Username":"alice","VisibleName":"Alice","Role":"admin"},{"Username":"bob","VisibleName":"Bob","Role":"owner"}]}`,
+			wantVersion: 1,
+			wantRoles:   []Role{RoleAdmin, RoleOwner},
+			wantNames:   []string{"Alice", "Bob"},
+		}, {
+			name:        "Test chat of newer version is not migrated",
+			giveJson:    `{"schemaVersion":99,"name":"me/chat","membersNum":1,"members":[{"Username":"alice"}]}`,
+			wantVersion: 99,
+			wantRoles:   []Role{""},
+			wantNames:   []string{""},
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseChatInfo([]byte(tt.giveJson))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantVersion, info.SchemaVersion)
+
+			var roles []Role
+			var names []string
+			for _, m := range info.Members {
+				roles = append(roles, m.Role)
+				names = append(names, m.VisibleName)
+			}
+			assert.Equal(t, tt.wantRoles, roles)
+			assert.Equal(t, tt.wantNames, names)
+		})
+	}
+}
+
+func TestChatInfoUnknownFields(t *testing.T) {
+	data := `{"schemaVersion":99,"name":"me/chat","description":"release talks",` +
+		`"members":[{"Username":"alice","Role":"owner","Key":{"type":"ssh"}}]}`
+
+	info, err := parseChatInfo([]byte(data))
+	assert.NoError(t, err)
+	info.Members[0].VisibleName = "Alice"
+
+	written, err := json.Marshal(info)
+	assert.NoError(t, err)
+
+	var fields map[string]any
+	assert.NoError(t, json.Unmarshal(written, &fields))
+	assert.Equal(t, "release talks", fields["description"])
+
+	members := fields["members"].([]any)
+	member := members[0].(map[string]any)
+	assert.Equal(t, "Alice", member["VisibleName"])
+	assert.Equal(t, map[string]any{"type": "ssh"}, member["Key"])
+}
+
+func TestMergeChatInfo(t *testing.T) {
+	base := ChatInfoJson{Name: "me/chat", Members: []chatMember{
+		{Username: "alice", VisibleName: "alice", Role: RoleOwner},
+		{Username: "bob", VisibleName: "bob", Role: RoleMember},
+	}}
+
+	subtests := []struct {
+		name        string
+		giveOurs    []chatMember
+		giveTheirs  []chatMember
+		wantMembers []chatMember
+	}{
+		{
+			name: "Test members joined at once are both added",
+			giveOurs: []chatMember{base.Members[0], base.Members[1],
+				{Username: "carol", VisibleName: "carol", Role: RoleMember}},
+			giveTheirs: []chatMember{base.Members[0], base.Members[1],
+				{Username: "dave", VisibleName: "dave", Role: RoleMember}},
+			wantMembers: []chatMember{base.Members[0], base.Members[1],
+				{Username: "dave", VisibleName: "dave", Role: RoleMember},
+				{Username: "carol", VisibleName: "carol", Role: RoleMember}},
+		}, {
+			name:        "Test member removed by them stays removed",
+			giveOurs:    []chatMember{{Username: "alice", VisibleName: "Alice", Role: RoleOwner}, base.Members[1]},
+			giveTheirs:  []chatMember{base.Members[0]},
+			wantMembers: []chatMember{{Username: "alice", VisibleName: "Alice", Role: RoleOwner}},
+		}, {
+			name:        "Test fields changed on both sides are merged",
+			giveOurs:    []chatMember{base.Members[0], {Username: "bob", VisibleName: "bob", Role: RoleAdmin}},
+			giveTheirs:  []chatMember{base.Members[0], {Username: "bob", VisibleName: "Bob", Role: RoleReadOnly}},
+			wantMembers: []chatMember{base.Members[0], {Username: "bob", VisibleName: "Bob", Role: RoleAdmin}},
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			ours := base
+			ours.Members = tt.giveOurs
+			theirs := base
+			theirs.Members = tt.giveTheirs
+
+			merged := mergeChatInfo(base, ours, theirs)
+			assert.Equal(t, tt.wantMembers, merged.Members)
+			assert.Equal(t, len(tt.wantMembers), merged.MembersNum)
+		})
+	}
+}
+
+func TestPendingCommits(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := testHistory(t, r, 4)
+
+	pending, err := pendingCommits(r, commits[3], commits[1])
+	assert.NoError(t, err)
+	var messages []string
+	for _, c := range pending {
+		messages = append(messages, c.Message)
+	}
+	assert.Equal(t, []string{"m2", "m3"}, messages)
+
+	pending, err = pendingCommits(r, commits[1], commits[3])
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestIsUnreachable(t *testing.T) {
+	subtests := []struct {
+		name    string
+		giveErr error
+		want    bool
+	}{
+		{
+			name:    "Test no error",
+			giveErr: nil,
+			want:    false,
+		}, {
+			name:    "Test refused connection",
+			giveErr: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")},
+			want:    true,
+		}, {
+			name:    "Test wrapped refused connection",
+			giveErr: fmt.Errorf("pulling: %w", errors.New("dial tcp 10.0.0.1:22: connect: connection refused")),
+			want:    true,
+		}, {
+			name:    "Test rejected push",
+			giveErr: errors.New("non-fast-forward update: refs/heads/master"),
+			want:    false,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isUnreachable(tt.giveErr))
+		})
+	}
+}
+
+func signedCommit(t *testing.T, r *git.Repository, author, msg string, key signingKey) *object.Commit {
+	sig := object.Signature{Name: author, When: time.Date(2024, 9, 15, 12, 0, 0, 0, time.UTC)}
+	c := &object.Commit{Author: sig, Committer: sig, Message: msg, TreeHash: plumbing.ZeroHash}
+	if key != nil {
+		payload := &plumbing.MemoryObject{}
+		if err := c.EncodeWithoutSignature(payload); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := payload.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := key.Sign(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.PGPSignature = string(signature)
+	}
+
+	obj := r.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = r.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newSSHTestKey(t *testing.T) sshKey {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshKey{signer: signer}
+}
+
+func newPGPTestKey(t *testing.T) pgpKey {
+	entity, err := openpgp.NewEntity("alice", "", "alice@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pgpKey{entity: entity}
+}
+
+func TestVerifyCommit(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceSSH := newSSHTestKey(t)
+	alicePGP := newPGPTestKey(t)
+	stranger := newSSHTestKey(t)
+
+	publicKey := func(key signingKey) string {
+		pub, err := key.publicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+	members := []chatMember{
+		{Username: "alice", SigningKey: publicKey(aliceSSH)},
+		{Username: "bob"},
+	}
+	pgpMembers := []chatMember{
+		{Username: "alice", SigningKey: publicKey(alicePGP)},
+		{Username: "bob"},
+	}
+
+	tampered := signedCommit(t, r, "alice", "hello", aliceSSH)
+	tampered.Message = "goodbye"
+
+	subtests := []struct {
+		name        string
+		giveCommit  *object.Commit
+		giveMembers []chatMember
+		want        SignatureState
+		wantSigner  string
+	}{
+		{
+			name:        "Test unsigned",
+			giveCommit:  signedCommit(t, r, "alice", "hello", nil),
+			giveMembers: members,
+			want:        SignatureNone,
+		}, {
+			name:        "Test ssh signed by author",
+			giveCommit:  signedCommit(t, r, "alice", "hello", aliceSSH),
+			giveMembers: members,
+			want:        SignatureVerified,
+			wantSigner:  "alice",
+		}, {
+			name:        "Test ssh signed by another member",
+			giveCommit:  signedCommit(t, r, "bob", "hello", aliceSSH),
+			giveMembers: members,
+			want:        SignatureVerified,
+			wantSigner:  "alice",
+		}, {
+			name:        "Test ssh signed by stranger",
+			giveCommit:  signedCommit(t, r, "alice", "hello", stranger),
+			giveMembers: members,
+			want:        SignatureUnverified,
+		}, {
+			name:        "Test ssh signed and changed",
+			giveCommit:  tampered,
+			giveMembers: members,
+			want:        SignatureUnverified,
+		}, {
+			name:        "Test openpgp signed by author",
+			giveCommit:  signedCommit(t, r, "alice", "hello", alicePGP),
+			giveMembers: pgpMembers,
+			want:        SignatureVerified,
+			wantSigner:  "alice",
+		}, {
+			name:        "Test openpgp signed without member key",
+			giveCommit:  signedCommit(t, r, "alice", "hello", alicePGP),
+			giveMembers: members,
+			want:        SignatureUnverified,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, signer := verifyCommit(tt.giveCommit, tt.giveMembers)
+			assert.Equal(t, tt.want, state)
+			assert.Equal(t, tt.wantSigner, signer)
+		})
+	}
+}
+
+func TestLeaveChat(t *testing.T) {
+	urls, become := setupLocalChats(t, 2)
+
+	become("alice")
+	for _, url := range urls {
+		if _, err := AddChat(url, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	become("bob")
+	var chats []Chat
+	for _, url := range urls {
+		chat, err := AddChat(url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chats = append(chats, chat)
+	}
+	assert.NotEqual(t, chats[0].Name, chats[1].Name)
+	assert.Equal(t, []string{"alice", "bob"}, memberNames(remoteChatInfo(t, urls[0]).Members))
+
+	_, err := SelectChat(chats[1])
+	assert.NoError(t, err)
+
+	chatPath, err := getChatPath(chats[0].Url.Path)
+	assert.NoError(t, err)
+
+	err = LeaveChat(chats[0], true)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(chatPath)
+	assert.True(t, os.IsNotExist(err))
+	if assert.Len(t, Chats, 1) {
+		assert.Equal(t, chats[1].Name, Chats[0].Name)
+		assert.Same(t, Chats[0], currChat)
+	}
+	assert.Equal(t, []string{"alice"}, memberNames(remoteChatInfo(t, urls[0]).Members))
+
+	// Leaving without telling the members keeps me there
+	err = LeaveChat(chats[1], false)
+	assert.NoError(t, err)
+	assert.Empty(t, Chats)
+	assert.Nil(t, currChat)
+	assert.Equal(t, []string{"alice", "bob"}, memberNames(remoteChatInfo(t, urls[1]).Members))
+
+	assert.ErrorIs(t, LeaveChat(chats[1], false), ErrNoMatchChatName)
+}
+
+func TestLeaveChatWithoutRoles(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	become("bob")
+	if _, err := AddChat(urls[0], "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chat was created before roles, so the owner is the first member
+	become("alice")
+	CollectChats()
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	repo, err := openChatRepo(currChat)
+	assert.NoError(t, err)
+	chatPath, err := getChatPath(currChat.Url.Path)
+	assert.NoError(t, err)
+	info, err := collectChatInfo(chatPath)
+	assert.NoError(t, err)
+	for i := range info.Members {
+		info.Members[i].Role = ""
+	}
+	assert.NoError(t, writeChatInfo(chatPath, info))
+	assert.NoError(t, commit(repo, infoFileName, "Update info.json"))
+	assert.NoError(t, push(repo, &git.PushOptions{}))
+	for _, m := range remoteChatInfo(t, urls[0]).Members {
+		assert.Equal(t, Role(""), m.Role)
+	}
+
+	err = LeaveChat(alice, true)
+	assert.NoError(t, err)
+
+	members := remoteChatInfo(t, urls[0]).Members
+	assert.Equal(t, []string{"bob"}, memberNames(members))
+	assert.Equal(t, RoleMember, memberRole(members, "bob"))
+}
+
+func TestUpdateChatInfoKeepsOutbox(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	if _, err := AddChat(urls[0], "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+
+	goOnline := goOffline(t)
+	_, err = SendMsg("sent offline")
+	assert.NoError(t, err)
+	goOnline()
+
+	// Somebody else pushes first, so info.json of bob is rejected
+	pushMsgAs(t, urls[0], "alice", "hello")
+
+	_, err = SetVisibleName("Bob")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"Update info.json", "sent offline", "hello"}, remoteMsgs(t, urls[0])[:3])
+	assert.Equal(t, "Bob", VisibleName(Chat{Members: remoteChatInfo(t, urls[0]).Members}, "bob"))
+}
+
+func TestPullMsgsSkipsSeenPending(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	if _, err := AddChat(urls[0], "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+
+	goOnline := goOffline(t)
+	_, err = SendMsg("sent offline")
+	assert.NoError(t, err)
+	goOnline()
+	pushMsgAs(t, urls[0], "alice", "hello")
+
+	repo, err := openChatRepo(currChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// My message is put after the one of alice, but only hers is new
+	newMsgs, err := pullMsgs(repo, seen.Hash(), &git.PullOptions{RemoteName: git.DefaultRemoteName})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, newMsgs)
+
+	pending, err := outboxCommits(repo)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "sent offline", msgFromCommit(pending[0]).Text)
+	}
+}
+
+func TestUnauthorisedPromotionIgnored(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	_, err = SendMsg("hello")
+	assert.NoError(t, err)
+	hello := currChat.LastMsg.Hash
+
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+
+	// Bob makes himself the owner bypassing the client
+	repo, err := openChatRepo(currChat)
+	assert.NoError(t, err)
+	chatPath, err := getChatPath(currChat.Url.Path)
+	assert.NoError(t, err)
+	info, err := collectChatInfo(chatPath)
+	assert.NoError(t, err)
+	for i := range info.Members {
+		if info.Members[i].Username == "bob" {
+			info.Members[i].Role = RoleOwner
+		}
+	}
+	assert.NoError(t, writeChatInfo(chatPath, info))
+	assert.NoError(t, commit(repo, infoFileName, "Update info.json"))
+	assert.NoError(t, push(repo, &git.PushOptions{}))
+
+	// and takes back the message of alice as a moderator
+	_, err = sendMsg(nil, retractText, trailer{trailerRetracts, hello})
+	assert.NoError(t, err)
+
+	become("alice")
+	CollectChats()
+	alice, err = SelectChat(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleMember, MemberRole(alice, "bob"))
+	assert.Equal(t, RoleOwner, MemberRole(alice, "alice"))
+
+	m, err := GetMsg(hello)
+	assert.NoError(t, err)
+	assert.False(t, m.Deleted)
+
+	// Changes allowed to their authors are still taken
+	alice, err = SetMemberRole("bob", RoleAdmin)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleAdmin, MemberRole(alice, "bob"))
+	assert.Equal(t, RoleAdmin, memberRole(remoteChatInfo(t, urls[0]).Members, "bob"))
+}
+
+func TestAllowedKeyChange(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceKey := newSSHTestKey(t)
+	otherKey := newSSHTestKey(t)
+	publicKey := func(key signingKey) string {
+		pub, err := key.publicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+
+	unsigned := ChatInfoJson{Members: []chatMember{{Username: "alice"}, {Username: "bob"}}}
+	published := cloneChatInfo(unsigned)
+	published.Members[0].SigningKey = publicKey(aliceKey)
+	replaced := cloneChatInfo(unsigned)
+	replaced.Members[0].SigningKey = publicKey(otherKey)
+	renamed := cloneChatInfo(published)
+	renamed.Members[0].VisibleName = "Alice"
+
+	subtests := []struct {
+		name       string
+		givePrev   ChatInfoJson
+		giveNext   ChatInfoJson
+		giveCommit *object.Commit
+		want       bool
+	}{
+		{
+			name:       "Test member publishes its key",
+			givePrev:   unsigned,
+			giveNext:   published,
+			giveCommit: signedCommit(t, r, "alice", "Update info.json", nil),
+			want:       true,
+		}, {
+			name:       "Test member publishes key of another",
+			givePrev:   unsigned,
+			giveNext:   published,
+			giveCommit: signedCommit(t, r, "bob", "Update info.json", nil),
+			want:       false,
+		}, {
+			name:       "Test member replaces its key",
+			givePrev:   published,
+			giveNext:   replaced,
+			giveCommit: signedCommit(t, r, "alice", "Update info.json", aliceKey),
+			want:       false,
+		}, {
+			name:       "Test member with key changes info.json signed",
+			givePrev:   published,
+			giveNext:   renamed,
+			giveCommit: signedCommit(t, r, "alice", "Update info.json", aliceKey),
+			want:       true,
+		}, {
+			name:       "Test member with key changes info.json unsigned",
+			givePrev:   published,
+			giveNext:   renamed,
+			giveCommit: signedCommit(t, r, "alice", "Update info.json", nil),
+			want:       false,
+		}, {
+			name:       "Test member with key changes info.json signed by another key",
+			givePrev:   published,
+			giveNext:   renamed,
+			giveCommit: signedCommit(t, r, "alice", "Update info.json", otherKey),
+			want:       false,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, allowedKeyChange(tt.givePrev, tt.giveNext, tt.giveCommit))
+		})
+	}
+}
+
+func TestSendMsgDropsFailedMsg(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	_, err = SendMsg("hello")
+	assert.NoError(t, err)
+
+	// The server declines the push for a reason other than being away
+	hook := filepath.Join(strings.TrimPrefix(urls[0], "file://"), "hooks", "pre-receive")
+	if err := os.MkdirAll(filepath.Dir(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, err = SendMsg("declined")
+	assert.Error(t, err)
+
+	repo, err := openChatRepo(currChat)
+	assert.NoError(t, err)
+	pending, err := outboxCommits(repo)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	if err := os.Remove(hook); err != nil {
+		t.Fatal(err)
+	}
+	_, err = SendMsg("declined")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"declined", "hello"}, remoteMsgs(t, urls[0])[:2])
+	assert.NotContains(t, remoteMsgs(t, urls[0])[2:], "declined")
+}
+
+// srvRef returns the commit the ref points to on the chat server
+func srvRef(t *testing.T, url string, name plumbing.ReferenceName) (*object.Commit, error) {
+	srv, err := git.PlainOpen(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := srv.Reference(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return srv.CommitObject(ref.Hash())
+}
+
+// startTopic makes the topic in the current chat with the messages
+// and returns the tip of the main branch it was forked from
+func startTopic(t *testing.T, url, name string, texts ...string) *object.Commit {
+	base, err := srvRef(t, url, plumbing.NewBranchReferenceName("master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateTopic(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SwitchTopic(name); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range texts {
+		if _, err := SendMsg(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base
+}
+
+func TestCreateTopic(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+
+	subtests := []struct {
+		name     string
+		giveName string
+		wantErr  error
+	}{
+		{
+			name:     "Test new topic",
+			giveName: "side",
+			wantErr:  nil,
+		}, {
+			name:     "Test existing topic",
+			giveName: "side",
+			wantErr:  ErrTopicExists,
+		}, {
+			name:     "Test main branch",
+			giveName: "master",
+			wantErr:  ErrInvalidTopicName,
+		}, {
+			name:     "Test name with space",
+			giveName: "side talk",
+			wantErr:  ErrInvalidTopicName,
+		}, {
+			name:     "Test HEAD",
+			giveName: "HEAD",
+			wantErr:  ErrInvalidTopicName,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateTopic(tt.giveName)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	main, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("master"))
+	assert.NoError(t, err)
+	topic, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("side"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, main.Hash, topic.Hash)
+	}
+
+	// Messages of the topic stay out of the main chat
+	chat, err := SwitchTopic("side")
+	assert.NoError(t, err)
+	assert.Equal(t, "side", chat.Topic)
+	_, err = SendMsg("in topic")
+	assert.NoError(t, err)
+
+	topic, err = srvRef(t, urls[0], plumbing.NewBranchReferenceName("side"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "in topic", msgFromCommit(topic).Text)
+	}
+	after, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("master"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, main.Hash, after.Hash)
+	}
+
+	chat, err = SwitchTopic("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", chat.Topic)
+	repo, err := openChatRepo(currChat)
+	assert.NoError(t, err)
+	branch, err := getCurrBranch(repo)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", branch)
+}
+
+func TestPourTopic(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+
+	subtests := []struct {
+		name        string
+		giveTexts   []string
+		givePour    func(name string) (Chat, error)
+		wantErr     error
+		wantParents int
+		wantTrailer string
+	}{
+		{
+			name:        "Test merge",
+			giveTexts:   []string{"first", "second"},
+			givePour:    MergeTopic,
+			wantParents: 2,
+			wantTrailer: trailerTopicMerged,
+		}, {
+			name:      "Test squash",
+			giveTexts: []string{"first", "second"},
+			givePour: func(name string) (Chat, error) {
+				return SquashTopic(name, "Agreed")
+			},
+			wantParents: 1,
+			wantTrailer: trailerTopicSquashed,
+		}, {
+			name:      "Test failed merge",
+			giveTexts: nil,
+			givePour:  MergeTopic,
+			wantErr:   ErrNothingToMerge,
+		}, {
+			name:      "Test failed squash",
+			giveTexts: nil,
+			givePour: func(name string) (Chat, error) {
+				return SquashTopic(name, "Agreed")
+			},
+			wantErr: ErrNothingToMerge,
+		},
+	}
+
+	for i, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("topic%d", i)
+			base := startTopic(t, urls[0], name, tt.giveTexts...)
+			tip, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chat, err := tt.givePour(name)
+			if tt.wantErr != nil {
+				// The topic stays selected, so my next message goes there
+				assert.ErrorIs(t, err, tt.wantErr)
+				chat, err = GetCurrChat()
+				assert.NoError(t, err)
+				assert.Equal(t, name, chat.Topic)
+				_, err = SendMsg("after")
+				assert.NoError(t, err)
+
+				topic, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName(name))
+				if assert.NoError(t, err) {
+					assert.Equal(t, "after", msgFromCommit(topic).Text)
+				}
+				main, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("master"))
+				if assert.NoError(t, err) {
+					assert.Equal(t, base.Hash, main.Hash)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "", chat.Topic)
+
+			main, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("master"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantParents, main.NumParents())
+			assert.Equal(t, base.Hash, main.ParentHashes[0])
+			if tt.wantParents == 2 {
+				assert.Equal(t, tip.Hash, main.ParentHashes[1])
+			}
+			_, trailers := parseTrailers(main.Message)
+			assert.Equal(t, name, trailers[tt.wantTrailer])
+
+			_, err = srvRef(t, urls[0], plumbing.NewBranchReferenceName(name))
+			assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+		})
+	}
+}
+
+func TestCloseTopic(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+
+	startTopic(t, urls[0], "side", "first")
+	tip, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("side"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat, err := CloseTopic("side")
+	assert.NoError(t, err)
+	assert.Equal(t, "", chat.Topic)
+	tag, err := srvRef(t, urls[0], archiveTagRef("side"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, tip.Hash, tag.Hash)
+	}
+	_, err = srvRef(t, urls[0], plumbing.NewBranchReferenceName("side"))
+	assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+
+	archived, err := ListArchivedTopics(chat)
+	assert.NoError(t, err)
+	if assert.Len(t, archived, 1) {
+		assert.Equal(t, "side", archived[0].Name)
+	}
+
+	_, err = ReopenTopic("side")
+	assert.NoError(t, err)
+	topic, err := srvRef(t, urls[0], plumbing.NewBranchReferenceName("side"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, tip.Hash, topic.Hash)
+	}
+	_, err = srvRef(t, urls[0], archiveTagRef("side"))
+	assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+
+	_, err = ReopenTopic("side")
+	assert.ErrorIs(t, err, ErrTopicNotFound)
+}
+
+func TestWithRetries(t *testing.T) {
+	failure := errors.New("unexpected")
+	subtests := []struct {
+		name      string
+		giveErrs  []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "Test pushed at once",
+			giveErrs:  []error{nil},
+			wantErr:   nil,
+			wantCalls: 1,
+		}, {
+			name:      "Test pushed after rejects",
+			giveErrs:  []error{ErrPushRejected, ErrPushRejected, nil},
+			wantErr:   nil,
+			wantCalls: 3,
+		}, {
+			name:      "Test always rejected",
+			giveErrs:  []error{ErrPushRejected, ErrPushRejected, ErrPushRejected, nil},
+			wantErr:   ErrPushRejected,
+			wantCalls: pushRetries,
+		}, {
+			name:      "Test other error",
+			giveErrs:  []error{failure, nil},
+			wantErr:   failure,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetries(0, func() error {
+				calls++
+				return tt.giveErrs[calls-1]
+			})
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestGetMsgsPage(t *testing.T) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := testHistory(t, r, 5)
+	err = r.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, commits[4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subtests := []struct {
+		name       string
+		giveBefore string
+		giveN      int
+		wantTexts  []string
+	}{
+		{
+			name:       "Test latest page",
+			giveBefore: "",
+			giveN:      2,
+			wantTexts:  []string{"m4", "m3"},
+		}, {
+			name:       "Test page before message",
+			giveBefore: commits[3].String(),
+			giveN:      2,
+			wantTexts:  []string{"m2", "m1"},
+		}, {
+			name:       "Test short page at the beginning",
+			giveBefore: commits[1].String(),
+			giveN:      2,
+			wantTexts:  []string{"m0"},
+		}, {
+			name:       "Test nothing before the first message",
+			giveBefore: commits[0].String(),
+			giveN:      2,
+			wantTexts:  nil,
+		}, {
+			name:       "Test page of whole chat",
+			giveBefore: "",
+			giveN:      5,
+			wantTexts:  []string{"m4", "m3", "m2", "m1", "m0"},
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := getMsgsPage(r, tt.giveBefore, tt.giveN)
+			assert.NoError(t, err)
+			var texts []string
+			for _, m := range page {
+				texts = append(texts, m.Text)
+			}
+			assert.Equal(t, tt.wantTexts, texts)
+		})
+	}
+}
+
+func TestGetMsgsBefore(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		if _, err := SendMsg(fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pages are loaded the way the dialogue does, while they are full
+	const n = 3
+	page, err := GetLatestMsgs(n)
+	assert.NoError(t, err)
+	msgs := page
+	hasOlder := len(page) == n
+	pages := 1
+	for hasOlder {
+		page, err = GetMsgsBefore(msgs[0].Hash, n)
+		assert.NoError(t, err)
+		msgs = append(page, msgs...)
+		hasOlder = len(page) == n
+		pages++
+	}
+
+	var texts []string
+	for _, m := range msgs {
+		texts = append(texts, m.Text)
+	}
+	want := remoteMsgs(t, urls[0])
+	slices.Reverse(want)
+	assert.Equal(t, want, texts)
+	assert.Equal(t, []string{"m3", "m4", "m5"}, texts[len(texts)-n:])
+	assert.Equal(t, (len(want)+n)/n, pages)
+}
+
+func TestSendAttachment(t *testing.T) {
+	urls, become := setupLocalChats(t, 1)
+	files := t.TempDir()
+
+	become("alice")
+	alice, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(alice)
+	assert.NoError(t, err)
+
+	subtests := []struct {
+		name     string
+		giveName string
+		giveSize int64
+		wantErr  error
+	}{
+		{
+			name:     "Test small file",
+			giveName: "notes.txt",
+			giveSize: 5,
+			wantErr:  nil,
+		}, {
+			name:     "Test file of the limit",
+			giveName: "limit.bin",
+			giveSize: maxAttachmentSize,
+			wantErr:  nil,
+		}, {
+			name:     "Test file over the limit",
+			giveName: "big.bin",
+			giveSize: maxAttachmentSize + 1,
+			wantErr:  ErrAttachmentSize,
+		},
+	}
+
+	for _, tt := range subtests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(files, tt.giveName)
+			data := bytes.Repeat([]byte("x"), int(tt.giveSize))
+			if err := os.WriteFile(src, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			chat, err := SendAttachment(src, "see "+tt.giveName)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.NotEqual(t, "see "+tt.giveName, remoteMsgs(t, urls[0])[0])
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.giveName, AttachmentName(chat.LastMsg))
+		})
+	}
+
+	// Bob saves the file alice sent
+	become("bob")
+	bob, err := AddChat(urls[0], "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SelectChat(bob)
+	assert.NoError(t, err)
+	msgs, err := GetLatestMsgs(10)
+	assert.NoError(t, err)
+
+	var notes, plain string
+	for _, m := range msgs {
+		switch {
+		case AttachmentName(m) == "notes.txt":
+			notes = m.Hash
+		case m.Attachment == "":
+			plain = m.Hash
+		}
+	}
+	if notes == "" || plain == "" {
+		t.Fatal("sent messages not found")
+	}
+	dest := t.TempDir()
+	saved, err := SaveAttachment(notes, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dest, "notes.txt"), saved)
+	data, err := os.ReadFile(saved)
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxxx", string(data))
+
+	_, err = SaveAttachment(plain, dest)
+	assert.ErrorIs(t, err, ErrNoAttachment)
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+)
+
+// infoSchemaVersion is the version of info.json this client writes.
+// Files without the version are of version 0
+const infoSchemaVersion int = 1
+
+// infoMigrations bring info.json one version up: the migration
+// at index i turns version i into version i+1
+var infoMigrations = []func(info *ChatInfoJson){
+	migrateInfoRoles,
+}
+
+// migrateInfoRoles writes down visible names and roles, which
+// chats created before them go without
+func migrateInfoRoles(info *ChatInfoJson) {
+	roles := make([]Role, len(info.Members))
+	for i, m := range info.Members {
+		roles[i] = memberRole(info.Members, m.Username)
+	}
+	for i := range info.Members {
+		if info.Members[i].VisibleName == "" {
+			info.Members[i].VisibleName = info.Members[i].Username
+		}
+		info.Members[i].Role = roles[i]
+	}
+	info.MembersNum = len(info.Members)
+}
+
+// migrateChatInfo runs the migrations from the version of info.json up to
+// the one of this client. Versions written by newer clients are kept as is
+func migrateChatInfo(info *ChatInfoJson) {
+	if info.SchemaVersion > infoSchemaVersion {
+		appConfig.LogDebug("Keep %s of newer version %d", infoFileName, info.SchemaVersion)
+		return
+	}
+
+	for v := info.SchemaVersion; v < infoSchemaVersion; v++ {
+		infoMigrations[v](info)
+		appConfig.LogDebug("Migrate %s to version %d", infoFileName, v+1)
+	}
+	info.SchemaVersion = infoSchemaVersion
+}
+
+// parseChatInfo decodes info.json and brings it to the current version
+func parseChatInfo(data []byte) (ChatInfoJson, error) {
+	var info ChatInfoJson
+	err := json.Unmarshal(data, &info)
+	if err != nil {
+		appConfig.LogErr(err, "unmarshalling %s", infoFileName)
+		return ChatInfoJson{}, err
+	}
+
+	migrateChatInfo(&info)
+	return info, nil
+}
+
+// jsonKeys returns the keys the fields of the struct are encoded with
+func jsonKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		keys[name] = true
+	}
+	return keys
+}
+
+// unknownFields returns the fields of the JSON object, which
+// the struct of type t has no place for
+func unknownFields(data []byte, t reflect.Type) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range jsonKeys(t) {
+		delete(fields, key)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// withUnknownFields adds the unknown fields to the encoded JSON object,
+// so newer clients do not lose what older ones know nothing about
+func withUnknownFields(data []byte, fields map[string]json.RawMessage) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.Write(bytes.TrimSuffix(data, []byte("}")))
+	for _, key := range keys {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(fields[key])
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (m *chatMember) UnmarshalJSON(data []byte) error {
+	type plain chatMember
+	if err := json.Unmarshal(data, (*plain)(m)); err != nil {
+		return err
+	}
+
+	var err error
+	m.unknown, err = unknownFields(data, reflect.TypeOf(plain{}))
+	return err
+}
+
+func (m chatMember) MarshalJSON() ([]byte, error) {
+	type plain chatMember
+	data, err := json.Marshal(plain(m))
+	if err != nil {
+		return nil, err
+	}
+	return withUnknownFields(data, m.unknown)
+}
+
+func (info *ChatInfoJson) UnmarshalJSON(data []byte) error {
+	type plain ChatInfoJson
+	if err := json.Unmarshal(data, (*plain)(info)); err != nil {
+		return err
+	}
+
+	var err error
+	info.unknown, err = unknownFields(data, reflect.TypeOf(plain{}))
+	return err
+}
+
+func (info ChatInfoJson) MarshalJSON() ([]byte, error) {
+	type plain ChatInfoJson
+	data, err := json.Marshal(plain(info))
+	if err != nil {
+		return nil, err
+	}
+	return withUnknownFields(data, info.unknown)
+}
+
+// cloneChatInfo copies info.json, so the copy stays intact when members
+// of the original are changed
+func cloneChatInfo(info ChatInfoJson) ChatInfoJson {
+	info.Members = slices.Clone(info.Members)
+	return info
+}
+
+// pick returns our value, if we changed it, otherwise theirs.
+// We write last, so our change wins
+func pick[T comparable](base, ours, theirs T) T {
+	if ours != base {
+		return ours
+	}
+	return theirs
+}
+
+// mergeUnknownFields merges the unknown fields key by key like pick does
+func mergeUnknownFields(base, ours, theirs map[string]json.RawMessage) map[string]json.RawMessage {
+	merged := make(map[string]json.RawMessage)
+	keys := make(map[string]bool)
+	for _, fields := range []map[string]json.RawMessage{base, ours, theirs} {
+		for key := range fields {
+			keys[key] = true
+		}
+	}
+
+	for key := range keys {
+		b, inBase := base[key]
+		o, inOurs := ours[key]
+		t, inTheirs := theirs[key]
+		switch {
+		case inOurs != inBase || string(o) != string(b):
+			if inOurs {
+				merged[key] = o
+			}
+		case inTheirs:
+			merged[key] = t
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+func mergeMember(base, ours, theirs chatMember) chatMember {
+	return chatMember{
+		Username:    theirs.Username,
+		VisibleName: pick(base.VisibleName, ours.VisibleName, theirs.VisibleName),
+		Activity:    pick(base.Activity, ours.Activity, theirs.Activity),
+		Role:        pick(base.Role, ours.Role, theirs.Role),
+		SigningKey:  pick(base.SigningKey, ours.SigningKey, theirs.SigningKey),
+		unknown:     mergeUnknownFields(base.unknown, ours.unknown, theirs.unknown),
+	}
+}
+
+func membersByName(members []chatMember) map[string]chatMember {
+	byName := make(map[string]chatMember)
+	for _, m := range members {
+		byName[m.Username] = m
+	}
+	return byName
+}
+
+// mergeMembers merges the members as a set keyed by username. A member
+// removed by either side is removed, one added by either side is added,
+// and fields of the member changed on both sides are merged one by one
+func mergeMembers(base, ours, theirs []chatMember) []chatMember {
+	baseMembers := membersByName(base)
+	ourMembers := membersByName(ours)
+
+	var merged []chatMember
+	seen := make(map[string]bool)
+	for _, t := range theirs {
+		seen[t.Username] = true
+		b, inBase := baseMembers[t.Username]
+		o, inOurs := ourMembers[t.Username]
+		switch {
+		case !inBase && !inOurs:
+			merged = append(merged, t)
+		case !inBase:
+			merged = append(merged, mergeMember(t, o, t))
+		case inOurs:
+			merged = append(merged, mergeMember(b, o, t))
+		}
+	}
+
+	// Our new members follow theirs, so the first member stays the first
+	for _, o := range ours {
+		if _, inBase := baseMembers[o.Username]; !inBase && !seen[o.Username] {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
+// mergeChatInfo merges our change of info.json made over base with
+// the one somebody else pushed first
+func mergeChatInfo(base, ours, theirs ChatInfoJson) ChatInfoJson {
+	merged := ChatInfoJson{
+		SchemaVersion: max(ours.SchemaVersion, theirs.SchemaVersion),
+		Url:           theirs.Url,
+		Name:          pick(base.Name, ours.Name, theirs.Name),
+		Members:       mergeMembers(base.Members, ours.Members, theirs.Members),
+		unknown:       mergeUnknownFields(base.unknown, ours.unknown, theirs.unknown),
+	}
+	if merged.Url == nil {
+		merged.Url = ours.Url
+	}
+	merged.MembersNum = len(merged.Members)
+	return merged
+}
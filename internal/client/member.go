@@ -0,0 +1,203 @@
+package client
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// MemberEmail returns the email the member commits with
+// to the current chat
+func MemberEmail(username string) (string, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return "", ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return "", err
+	}
+
+	cIter, err := repo.Log(&git.LogOptions{All: true})
+	if err != nil {
+		appConfig.LogErr(err, "retrieving log")
+		return "", err
+	}
+
+	var email string
+	err = cIter.ForEach(func(c *object.Commit) error {
+		if c.Author.Name == username && c.Author.Email != "" {
+			email = c.Author.Email
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over log")
+		return "", err
+	}
+
+	if email == "" {
+		appConfig.LogErr(ErrMemberNotFound, "no commits of %s", username)
+		return "", ErrMemberNotFound
+	}
+	return email, nil
+}
+
+// DirectTopicName returns the same topic name for both members,
+// keeping only the characters allowed in topic names
+func DirectTopicName(a, b string) string {
+	names := []string{a, b}
+	sort.Strings(names)
+	for i := range names {
+		names[i] = strings.Map(func(r rune) rune {
+			if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '.' || r == '_' {
+				return r
+			}
+			return '_'
+		}, names[i])
+	}
+	return "dm-" + names[0] + "-" + names[1]
+}
+
+// DirectTopic returns the topic of the current chat named after me
+// and the member and creates it on the first call. It is a regular
+// topic, so it is not private: every member can read and write to it.
+// Switch to it with SwitchTopic
+func DirectTopic(username string) (string, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return "", ErrCurrChatNil
+	}
+
+	// Members are refreshed by polling
+	chat.mu.Lock()
+	found := slices.ContainsFunc(chat.Members, func(m chatMember) bool {
+		return m.Username == username
+	})
+	chat.mu.Unlock()
+	if !found {
+		appConfig.LogErr(ErrMemberNotFound, "%s in %s", username, chat.Name)
+		return "", ErrMemberNotFound
+	}
+
+	me, err := GetUserName()
+	if err != nil {
+		return "", err
+	}
+
+	name := DirectTopicName(me, username)
+	_, err = CreateTopic(name)
+	if err != nil && !errors.Is(err, ErrTopicExists) {
+		return "", err
+	}
+	return name, nil
+}
+
+// VisibleName returns the name the member shows in the chat,
+// or the username if the member has not set one
+func VisibleName(c Chat, username string) string {
+	for _, m := range c.Members {
+		if m.Username == username && m.VisibleName != "" {
+			return m.VisibleName
+		}
+	}
+	return username
+}
+
+// changeChatInfo applies the change to info.json of the current chat
+// and publishes it. Members are kept in the main chat, so it is not
+// changed while a topic is selected
+func changeChatInfo(change func(info *ChatInfoJson, me string) error) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	err := func() error {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+
+		if chat.Topic != "" {
+			appConfig.LogErr(ErrTopicSelected, "changing %s of %s", infoFileName, chat.Name)
+			return ErrTopicSelected
+		}
+
+		repo, err := openChatRepo(chat)
+		if err != nil {
+			return err
+		}
+
+		info, err := mainChatInfo(repo)
+		if err != nil {
+			return err
+		}
+
+		username, err := GetUserName()
+		if err != nil {
+			return err
+		}
+
+		base := cloneChatInfo(info)
+		err = change(&info, username)
+		if err != nil {
+			return err
+		}
+
+		auth, err := getAuth(chat.username, chat.password)
+		if err != nil {
+			return err
+		}
+
+		info, err = updateChatInfo(repo, base, info, auth)
+		if err != nil {
+			return err
+		}
+
+		chat.Members = info.Members
+		chat.MembersNum = info.MembersNum
+		chat.MsgNum += 1
+		chat.LastMsg, err = getLastMsg(repo)
+		return err
+	}()
+	if err != nil {
+		return Chat{}, err
+	}
+	return *chat, nil
+}
+
+// SetVisibleName changes my name shown to the members of the current chat.
+// It is stored in info.json, so it is changed in the main chat only
+func SetVisibleName(name string) (Chat, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "\r\n") {
+		appConfig.LogErr(ErrInvalidName, "visible name %q", name)
+		return Chat{}, ErrInvalidName
+	}
+
+	return changeChatInfo(func(info *ChatInfoJson, me string) error {
+		if !RoleAllows(memberRole(info.Members, me), PermWrite) {
+			appConfig.LogErr(ErrNotPermitted, "setting visible name of %s", me)
+			return ErrNotPermitted
+		}
+
+		for i := range info.Members {
+			if info.Members[i].Username == me {
+				info.Members[i].VisibleName = name
+			}
+		}
+		appConfig.LogDebug("Set visible name %s", name)
+		return nil
+	})
+}
@@ -0,0 +1,313 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// applyEdit replaces the text of the message with the edited one and keeps
+// the previous version in the history
+func applyEdit(m *Message, edit Message) {
+	if edit.Author != m.Author {
+		appConfig.LogDebug("Skip edit %s of %s by other author %s", edit.Hash, m.Hash, edit.Author)
+		return
+	}
+
+	if m.Deleted {
+		return
+	}
+
+	prev := Message{Text: m.Text, Author: m.Author, Time: m.Time, Hash: m.Hash}
+	if m.Edited {
+		prev.Time = m.EditTime
+	}
+
+	m.History = append(m.History, prev)
+	m.Text = edit.Text
+	m.Edited = true
+	m.EditTime = edit.Time
+}
+
+// applyRetract hides the text of the message, if it is retracted
+// by its author or by a moderator of the chat
+func applyRetract(m *Message, retract Message, mods map[string]bool) {
+	if retract.Author != m.Author && !mods[retract.Author] {
+		appConfig.LogDebug("Skip retract %s of %s by other author %s", retract.Hash, m.Hash, retract.Author)
+		return
+	}
+
+	m.Text = ""
+	m.History = nil
+	m.Deleted = true
+}
+
+// applyFollowUp applies the edit or retract commit to the message
+func applyFollowUp(m *Message, f Message, mods map[string]bool) {
+	switch {
+	case f.Edits != "":
+		applyEdit(m, f)
+	case f.Retracts != "":
+		applyRetract(m, f, mods)
+	}
+}
+
+// followUpTarget returns the hash of the message changed by the commit,
+// e.g. by edit or retract, or empty string for a plain message
+func followUpTarget(m Message) string {
+	if m.Edits != "" {
+		return m.Edits
+	}
+	return m.Retracts
+}
+
+// foldMsgs applies edit and retract commits to the messages they refer to
+// and drops them from the dialogue. If the changed message is older than
+// msgs, it is loaded with resolve and put in place of the follow-up.
+// Messages come from the most recent ones
+func foldMsgs(msgs []Message, mods map[string]bool, resolve func(hash string) (Message, error)) []Message {
+	index := make(map[string]int)
+	ids := make(map[string]bool)
+	var folded []Message
+
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		if m.MsgId != "" {
+			// The message was sent twice, e.g. after a failed push
+			if ids[m.MsgId] {
+				continue
+			}
+			ids[m.MsgId] = true
+		}
+
+		target := followUpTarget(m)
+		if target == "" {
+			index[m.Hash] = len(folded)
+			folded = append(folded, m)
+			continue
+		}
+
+		if j, ok := index[target]; ok {
+			applyFollowUp(&folded[j], m, mods)
+			continue
+		}
+
+		orig, err := resolve(target)
+		if err != nil {
+			continue
+		}
+		index[orig.Hash] = len(folded)
+		folded = append(folded, orig)
+	}
+
+	// Return them from the most recent ones as well
+	for i, j := 0, len(folded)-1; i < j; i, j = i+1, j-1 {
+		folded[i], folded[j] = folded[j], folded[i]
+	}
+	return folded
+}
+
+// loadMsg returns the message by its hash with all later edits
+// and retracts applied, and its reactions
+func loadMsg(r *git.Repository, hash string) (Message, error) {
+	target := plumbing.NewHash(hash)
+	c, err := r.CommitObject(target)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving message %s", hash)
+		return Message{}, err
+	}
+	m := msgFromCommit(c)
+
+	cIter, err := r.Log(&git.LogOptions{Order: git.LogOrderCommitterTime})
+	if err != nil {
+		appConfig.LogErr(err, "retrieving log")
+		return Message{}, err
+	}
+
+	// Follow-ups are newer than the message, so stop the log at it
+	var followUps []Message
+	err = cIter.ForEach(func(c *object.Commit) error {
+		if c.Hash == target {
+			return storer.ErrStop
+		}
+		if f := msgFromCommit(c); followUpTarget(f) == hash {
+			followUps = append(followUps, f)
+		}
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over log")
+		return Message{}, err
+	}
+
+	mods := moderators(r)
+	for i := len(followUps) - 1; i >= 0; i-- {
+		applyFollowUp(&m, followUps[i], mods)
+	}
+
+	tree, err := reactionNotes(r, getReactionsTip(r))
+	if err == nil {
+		m.Reactions = readReactions(tree, hash)
+	}
+	m.SeenBy = seenBy(unseenCommits(r), m)
+	msgs := []Message{m}
+	addPending(r, msgs)
+	addSignatures(r, msgs)
+	return msgs[0], nil
+}
+
+// getMsgsPage returns up to n messages older than the message with before
+// hash, or the latest ones if before is empty. Edits and retracts newer than
+// the page are applied to its messages. Messages come from the most recent ones
+func getMsgsPage(r *git.Repository, before string, n int) ([]Message, error) {
+	cIter, err := r.Log(&git.LogOptions{Order: git.LogOrderCommitterTime})
+	if err != nil {
+		appConfig.LogErr(err, "retrieving log")
+		return nil, err
+	}
+
+	followUps := make(map[string][]Message)
+	ids := make(map[string]bool)
+	skip := before != ""
+	var page []Message
+	err = cIter.ForEach(func(c *object.Commit) error {
+		m := msgFromCommit(c)
+		if target := followUpTarget(m); target != "" {
+			followUps[target] = append(followUps[target], m)
+			return nil
+		}
+
+		// The message was sent twice, e.g. after a failed push
+		if m.MsgId != "" {
+			if ids[m.MsgId] {
+				return nil
+			}
+			ids[m.MsgId] = true
+		}
+
+		if skip {
+			skip = m.Hash != before
+			return nil
+		}
+
+		if len(page) == n {
+			return storer.ErrStop
+		}
+		page = append(page, m)
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over log")
+		return nil, err
+	}
+
+	mods := moderators(r)
+	for i := range page {
+		fs := followUps[page[i].Hash]
+		// Follow-ups come from the most recent ones as well
+		for j := len(fs) - 1; j >= 0; j-- {
+			applyFollowUp(&page[i], fs[j], mods)
+		}
+	}
+	addReactions(r, page)
+	addReceipts(r, page)
+	addPending(r, page)
+	addSignatures(r, page)
+	return page, nil
+}
+
+func getCurrChatMsgsPage(before string, n int) ([]Message, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return nil, ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := getMsgsPage(repo, before, n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return them in the dialogue order
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// GetLatestMsgs returns up to n latest messages of the current chat,
+// from the oldest to the most recent one
+func GetLatestMsgs(n int) ([]Message, error) {
+	return getCurrChatMsgsPage("", n)
+}
+
+// GetMsgsBefore returns up to n messages of the current chat sent before
+// the message with the hash, from the oldest to the most recent one.
+// Fewer than n messages means the beginning of the chat
+func GetMsgsBefore(hash string, n int) ([]Message, error) {
+	return getCurrChatMsgsPage(hash, n)
+}
+
+// checkMsgAuthor returns the message by its hash, if I am its author
+func checkMsgAuthor(hash string) (Message, error) {
+	m, err := GetMsg(hash)
+	if err != nil {
+		return Message{}, err
+	}
+
+	username, err := GetUserName()
+	if err != nil {
+		return Message{}, err
+	}
+
+	if m.Author != username {
+		appConfig.LogErr(ErrNotMsgAuthor, "message %s of %s", hash, m.Author)
+		return Message{}, ErrNotMsgAuthor
+	}
+	return m, nil
+}
+
+// EditMsg replaces the text of my message in the current chat by sending
+// a follow-up commit with the "Edits: <hash>" trailer
+func EditMsg(hash string, text string) (Chat, error) {
+	m, err := checkMsgAuthor(hash)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	if m.Deleted {
+		appConfig.LogErr(ErrMsgDeleted, "edit message %s", hash)
+		return Chat{}, ErrMsgDeleted
+	}
+
+	return sendMsg(nil, text, trailer{trailerEdits, hash})
+}
+
+const retractText string = "Message deleted"
+
+// RetractMsg takes back my message in the current chat by sending
+// a tombstone commit with the "Retracts: <hash>" trailer. Moderators
+// may take back messages of others as well
+func RetractMsg(hash string) (Chat, error) {
+	_, err := checkMsgAuthor(hash)
+	if c := getCurrChat(); errors.Is(err, ErrNotMsgAuthor) && c != nil && Allowed(*c, PermModerate) {
+		err = nil
+	}
+	if err != nil {
+		return Chat{}, err
+	}
+
+	return sendMsg(nil, retractText, trailer{trailerRetracts, hash})
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Messages, which could not be pushed, stay committed in the local branch.
+// These commits are the outbox of the chat, it is pushed once the server
+// can be reached again
+
+// newMsgId returns a random id of the message. It is kept when the message
+// is replayed, so the same message is never sent twice
+func newMsgId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		appConfig.LogErr(err, "generating message id")
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+var unreachableErrs = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"network is unreachable",
+	"no route to host",
+	"i/o timeout",
+}
+
+// isUnreachable reports whether the server of the chat cannot be reached,
+// e.g. I am offline
+func isUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	for _, s := range unreachableErrs {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboxCommits returns the commits of the checked out branch, which are
+// not pushed yet, from the oldest one
+func outboxCommits(r *git.Repository) ([]*object.Commit, error) {
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := r.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving branch %s", branch)
+		return nil, err
+	}
+
+	remote, err := r.Reference(remoteBranchRef(branch), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// Branch was never pushed, so there is nothing to compare with
+		return nil, nil
+	}
+	if err != nil {
+		appConfig.LogErr(err, "retrieving remote branch %s", branch)
+		return nil, err
+	}
+
+	return pendingCommits(r, local.Hash(), remote.Hash())
+}
+
+// addPending marks the messages waiting in the outbox
+func addPending(r *git.Repository, msgs []Message) {
+	commits, err := outboxCommits(r)
+	if err != nil || len(commits) == 0 {
+		return
+	}
+
+	pending := make(map[string]bool)
+	for _, c := range commits {
+		pending[c.Hash.String()] = true
+	}
+	for i := range msgs {
+		msgs[i].Pending = pending[msgs[i].Hash]
+	}
+}
+
+// dropMsg takes my message, which failed to be sent, out of the branch,
+// so it is not pushed later along with the outbox and can be sent again
+func dropMsg(r *git.Repository, msgId string) error {
+	head, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return err
+	}
+
+	c, err := r.CommitObject(head.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit %s", head.Hash())
+		return err
+	}
+
+	if msgFromCommit(c).MsgId != msgId || c.NumParents() != 1 {
+		err = fmt.Errorf("message %s is not the last one", msgId)
+		appConfig.LogErr(err, "dropping message")
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return err
+	}
+
+	err = w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: c.ParentHashes[0]})
+	if err != nil {
+		appConfig.LogErr(err, "dropping message %s", msgId)
+		return err
+	}
+	return nil
+}
+
+// pushPending pushes the branch. If somebody else pushed first,
+// my messages are put after theirs and pushed again. It reports
+// whether the branch was rebased
+func pushPending(r *git.Repository, branch string, auth transport.AuthMethod) (bool, error) {
+	rebased := false
+	err := withRetries(retryDelay, func() error {
+		err := push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(branch)}})
+		if !isPushRejected(err) {
+			return err
+		}
+
+		ok, rebaseErr := rebasePending(r, branch, auth)
+		if rebaseErr != nil {
+			return rebaseErr
+		}
+		rebased = rebased || ok
+		return ErrPushRejected
+	})
+	return rebased, err
+}
+
+// flushOutbox pushes the messages waiting in the outbox of the checked out
+// branch and returns them as they are after the push
+func flushOutbox(r *git.Repository, auth transport.AuthMethod) ([]Message, error) {
+	commits, err := outboxCommits(r)
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages are loaded from the one before the oldest pending
+	before := commits[0].ParentHashes[0]
+
+	_, err = pushPending(r, branch, auth)
+	if err != nil {
+		return nil, err
+	}
+	appConfig.LogDebug("Flush %d messages from outbox of %s", len(commits), branch)
+
+	return getMsgs(r, before)
+}
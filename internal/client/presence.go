@@ -0,0 +1,220 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Heartbeats are refs pointing at a commit outside of the chat history.
+// Its committer time is when the heartbeat was sent and its author time
+// is my last activity in the app
+const presenceRefPrefix string = "refs/gitogram/presence/"
+
+const (
+	heartbeatPeriod time.Duration = 2 * time.Minute
+	// Heartbeat may be late by a poll of all the chats
+	offlineAfter time.Duration = 2*heartbeatPeriod + time.Minute
+	idleAfter    time.Duration = 5 * time.Minute
+)
+
+type PresenceState int
+
+const (
+	PresenceOffline PresenceState = iota
+	PresenceIdle
+	PresenceOnline
+)
+
+func (s PresenceState) String() string {
+	switch s {
+	case PresenceOnline:
+		return "online"
+	case PresenceIdle:
+		return "idle"
+	default:
+		return "offline"
+	}
+}
+
+// Presence is what the last heartbeat of the member tells
+type Presence struct {
+	State    PresenceState
+	Activity time.Time
+}
+
+var activity = struct {
+	mu   sync.Mutex
+	last time.Time
+}{last: time.Now()}
+
+// Touch records my activity in the app, e.g. a pressed key
+func Touch() {
+	activity.mu.Lock()
+	defer activity.mu.Unlock()
+
+	activity.last = time.Now()
+}
+
+func lastActivity() time.Time {
+	activity.mu.Lock()
+	defer activity.mu.Unlock()
+
+	return activity.last
+}
+
+func presenceRefSpec() config.RefSpec {
+	return config.RefSpec(fmt.Sprintf("+%s*:%s*", presenceRefPrefix, presenceRefPrefix))
+}
+
+// writeHeartbeat makes a parentless commit with the empty tree, so
+// heartbeats never get into the chat history
+func writeHeartbeat(r *git.Repository, active time.Time) (plumbing.Hash, error) {
+	treeObj := r.Storer.NewEncodedObject()
+	if err := (&object.Tree{}).Encode(treeObj); err != nil {
+		appConfig.LogErr(err, "encoding heartbeat tree")
+		return plumbing.ZeroHash, err
+	}
+	treeHash, err := r.Storer.SetEncodedObject(treeObj)
+	if err != nil {
+		appConfig.LogErr(err, "writing heartbeat tree")
+		return plumbing.ZeroHash, err
+	}
+
+	committer, err := commitAuthor()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	author := *committer
+	author.When = active
+
+	c := &object.Commit{
+		Author:    author,
+		Committer: *committer,
+		Message:   "Heartbeat\n",
+		TreeHash:  treeHash,
+	}
+
+	commitObj := r.Storer.NewEncodedObject()
+	if err := c.Encode(commitObj); err != nil {
+		appConfig.LogErr(err, "encoding heartbeat")
+		return plumbing.ZeroHash, err
+	}
+	hash, err := r.Storer.SetEncodedObject(commitObj)
+	if err != nil {
+		appConfig.LogErr(err, "writing heartbeat")
+		return plumbing.ZeroHash, err
+	}
+	return hash, nil
+}
+
+// sendHeartbeat tells the others I am here
+func sendHeartbeat(r *git.Repository, auth transport.AuthMethod, active time.Time) error {
+	username, err := GetUserName()
+	if err != nil {
+		return err
+	}
+
+	hash, err := writeHeartbeat(r, active)
+	if err != nil {
+		return err
+	}
+
+	name := memberRefName(presenceRefPrefix, username)
+	err = r.Storer.SetReference(plumbing.NewHashReference(name, hash))
+	if err != nil {
+		appConfig.LogErr(err, "updating heartbeat")
+		return err
+	}
+
+	// Every heartbeat is a new commit, so the ref is forced
+	err = push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("+%s:%s", name, name)),
+	}})
+	if err != nil {
+		appConfig.LogErr(err, "pushing heartbeat")
+		return err
+	}
+	return nil
+}
+
+// heartbeatDue reports whether the chat should get a heartbeat: the last
+// one is getting old, or I came back after being idle
+func heartbeatDue(c *Chat, active time.Time) bool {
+	if time.Since(c.heartbeatAt) >= heartbeatPeriod {
+		return true
+	}
+	return c.heartbeatIdle && time.Since(active) < idleAfter
+}
+
+func presenceState(heartbeat, active, now time.Time) PresenceState {
+	switch {
+	case now.Sub(heartbeat) >= offlineAfter:
+		return PresenceOffline
+	case now.Sub(active) >= idleAfter:
+		return PresenceIdle
+	default:
+		return PresenceOnline
+	}
+}
+
+// getPresence returns the presence of each member, who sent a heartbeat
+func getPresence(r *git.Repository) map[string]Presence {
+	presence := make(map[string]Presence)
+	now := time.Now()
+	for username, hash := range getMemberRefs(r, presenceRefPrefix, "") {
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			continue
+		}
+		presence[username] = Presence{
+			State:    presenceState(c.Committer.When, c.Author.When, now),
+			Activity: c.Author.When,
+		}
+	}
+	return presence
+}
+
+// updatePresence sends a heartbeat to the chat when it is due and refreshes
+// the presence of the members. It reports whether any state changed
+func updatePresence(c *Chat, r *git.Repository, auth transport.AuthMethod) bool {
+	active := lastActivity()
+	if heartbeatDue(c, active) {
+		if sendHeartbeat(r, auth, active) == nil {
+			c.heartbeatAt = time.Now()
+			c.heartbeatIdle = time.Since(active) >= idleAfter
+		}
+	}
+
+	presence := getPresence(r)
+	changed := len(presence) != len(c.Presence)
+	for username, p := range presence {
+		if c.Presence[username].State != p.State {
+			changed = true
+		}
+	}
+	c.Presence = presence
+	return changed
+}
+
+// OnlineNum returns how many members of the chat are online and idle
+func OnlineNum(c Chat) (int, int) {
+	online, idle := 0, 0
+	for _, p := range c.Presence {
+		switch p.State {
+		case PresenceOnline:
+			online++
+		case PresenceIdle:
+			idle++
+		}
+	}
+	return online, idle
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Reactions are kept in git notes, so they do not add commits to the chat.
+// The note of a message lists "<emoji> <username>" lines
+const reactionsRef plumbing.ReferenceName = "refs/notes/gitogram-reactions"
+
+// reactionsRefSpec matches the notes as a wildcard, so it is not an error
+// to fetch them before anybody reacted
+func reactionsRefSpec() config.RefSpec {
+	return config.RefSpec(fmt.Sprintf("+%s*:%s*", reactionsRef, reactionsRef))
+}
+
+// fetchReactions replaces local reactions with the remote ones
+func fetchReactions(r *git.Repository, auth transport.AuthMethod) error {
+	return fetch(r, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{reactionsRefSpec()},
+		Auth:       auth,
+	})
+}
+
+func pushReactions(r *git.Repository, auth transport.AuthMethod) error {
+	err := push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("%s:%s", reactionsRef, reactionsRef)),
+	}})
+	if isPushRejected(err) {
+		return ErrPushRejected
+	}
+	return err
+}
+
+// getReactionsTip returns the last commit of the reactions notes,
+// or zero hash if nobody reacted yet
+func getReactionsTip(r *git.Repository) plumbing.Hash {
+	ref, err := r.Reference(reactionsRef, true)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return ref.Hash()
+}
+
+// reactionNotes returns the notes tree at the commit
+func reactionNotes(r *git.Repository, tip plumbing.Hash) (*object.Tree, error) {
+	if tip.IsZero() {
+		return &object.Tree{}, nil
+	}
+
+	c, err := r.CommitObject(tip)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving reactions commit %s", tip)
+		return nil, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving reactions tree %s", tip)
+		return nil, err
+	}
+	return tree, nil
+}
+
+func parseReactions(note string) map[string]string {
+	reactions := make(map[string]string)
+	for _, line := range strings.Split(note, "\n") {
+		emoji, username, ok := strings.Cut(line, " ")
+		if !ok || emoji == "" || username == "" {
+			continue
+		}
+		reactions[username] = emoji
+	}
+	return reactions
+}
+
+func formatReactions(reactions map[string]string) string {
+	usernames := make([]string, 0, len(reactions))
+	for username := range reactions {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var b strings.Builder
+	for _, username := range usernames {
+		fmt.Fprintf(&b, "%s %s\n", reactions[username], username)
+	}
+	return b.String()
+}
+
+func readReactions(tree *object.Tree, hash string) map[string]string {
+	f, err := tree.File(hash)
+	if err != nil {
+		return nil
+	}
+
+	note, err := f.Contents()
+	if err != nil {
+		appConfig.LogErr(err, "reading reactions to %s", hash)
+		return nil
+	}
+	return parseReactions(note)
+}
+
+// addReactions fills in the reactions to the messages
+func addReactions(r *git.Repository, msgs []Message) {
+	tree, err := reactionNotes(r, getReactionsTip(r))
+	if err != nil {
+		return
+	}
+
+	for i := range msgs {
+		msgs[i].Reactions = readReactions(tree, msgs[i].Hash)
+	}
+}
+
+// reactedMsgs returns the messages of the checked out branch,
+// whose reactions changed since the tip of the reactions notes
+func reactedMsgs(r *git.Repository, since plumbing.Hash) ([]Message, error) {
+	tip := getReactionsTip(r)
+	if tip == since {
+		return nil, nil
+	}
+
+	prevTree, err := reactionNotes(r, since)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := reactionNotes(r, tip)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]bool)
+	prev := make(map[string]plumbing.Hash)
+	for _, e := range prevTree.Entries {
+		prev[e.Name] = e.Hash
+	}
+	for _, e := range tree.Entries {
+		if prev[e.Name] != e.Hash {
+			changed[e.Name] = true
+		}
+		delete(prev, e.Name)
+	}
+	for name := range prev {
+		changed[name] = true
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return nil, err
+	}
+
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit")
+		return nil, err
+	}
+
+	var msgs []Message
+	for hash := range changed {
+		c, err := r.CommitObject(plumbing.NewHash(hash))
+		if err != nil {
+			continue
+		}
+
+		// The message may be in a topic we are not in
+		if c.Hash != head.Hash {
+			if ok, err := c.IsAncestor(head); err != nil || !ok {
+				continue
+			}
+		}
+
+		m, err := loadMsg(r, hash)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func writeBlob(r *git.Repository, data string) (plumbing.Hash, error) {
+	obj := r.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := w.Write([]byte(data)); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.Storer.SetEncodedObject(obj)
+}
+
+// writeReactions commits the reactions to the message on top of
+// the reactions notes
+func writeReactions(r *git.Repository, hash string, reactions map[string]string) error {
+	tip := getReactionsTip(r)
+	prevTree, err := reactionNotes(r, tip)
+	if err != nil {
+		return err
+	}
+
+	var entries []object.TreeEntry
+	for _, e := range prevTree.Entries {
+		if e.Name != hash {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(reactions) > 0 {
+		blob, err := writeBlob(r, formatReactions(reactions))
+		if err != nil {
+			appConfig.LogErr(err, "writing reactions to %s", hash)
+			return err
+		}
+		entries = append(entries, object.TreeEntry{Name: hash, Mode: filemode.Regular, Hash: blob})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	treeObj := r.Storer.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(treeObj); err != nil {
+		appConfig.LogErr(err, "encoding reactions tree")
+		return err
+	}
+	treeHash, err := r.Storer.SetEncodedObject(treeObj)
+	if err != nil {
+		appConfig.LogErr(err, "writing reactions tree")
+		return err
+	}
+
+	author, err := commitAuthor()
+	if err != nil {
+		return err
+	}
+
+	c := &object.Commit{
+		Author:    *author,
+		Committer: *author,
+		Message:   fmt.Sprintf("Update reactions to %s\n", hash),
+		TreeHash:  treeHash,
+	}
+	if !tip.IsZero() {
+		c.ParentHashes = []plumbing.Hash{tip}
+	}
+
+	commitObj := r.Storer.NewEncodedObject()
+	if err := c.Encode(commitObj); err != nil {
+		appConfig.LogErr(err, "encoding reactions commit")
+		return err
+	}
+	commitHash, err := r.Storer.SetEncodedObject(commitObj)
+	if err != nil {
+		appConfig.LogErr(err, "writing reactions commit")
+		return err
+	}
+
+	return r.Storer.SetReference(plumbing.NewHashReference(reactionsRef, commitHash))
+}
+
+func react(r *git.Repository, hash, emoji string, auth transport.AuthMethod) error {
+	err := fetchReactions(r, auth)
+	if err != nil {
+		return err
+	}
+
+	username, err := GetUserName()
+	if err != nil {
+		return err
+	}
+
+	tip := getReactionsTip(r)
+	tree, err := reactionNotes(r, tip)
+	if err != nil {
+		return err
+	}
+
+	reactions := readReactions(tree, hash)
+	if reactions == nil {
+		reactions = make(map[string]string)
+	}
+
+	// The same reaction once again takes it back
+	if reactions[username] == emoji {
+		delete(reactions, username)
+	} else {
+		reactions[username] = emoji
+	}
+
+	err = writeReactions(r, hash, reactions)
+	if err != nil {
+		return err
+	}
+
+	err = pushReactions(r, auth)
+	if err != nil {
+		// Drop the reaction, the remote notes are fetched again on retry
+		if tip.IsZero() {
+			r.Storer.RemoveReference(reactionsRef)
+		} else {
+			r.Storer.SetReference(plumbing.NewHashReference(reactionsRef, tip))
+		}
+		return err
+	}
+	return nil
+}
+
+// React puts my emoji reaction on the message of the current chat,
+// or takes it back if I already reacted with the same emoji.
+// Each member has a single reaction to a message
+func React(hash, emoji string) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	if emoji == "" || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		appConfig.LogErr(ErrInvalidReaction, "reaction %q", emoji)
+		return Chat{}, ErrInvalidReaction
+	}
+
+	var m Message
+	err := func() error {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+
+		if err := checkPermission(chat, PermWrite); err != nil {
+			return err
+		}
+
+		repo, err := openChatRepo(chat)
+		if err != nil {
+			return err
+		}
+
+		auth, err := getAuth(chat.username, chat.password)
+		if err != nil {
+			return err
+		}
+
+		err = withRetries(retryDelay, func() error {
+			return react(repo, hash, emoji, auth)
+		})
+		if err != nil {
+			return err
+		}
+		appConfig.LogDebug("React %s to %s in %s", emoji, hash, chat.Name)
+
+		m, err = loadMsg(repo, hash)
+		return err
+	}()
+	if err != nil {
+		return Chat{}, err
+	}
+
+	go func() {
+		printMsgs([]Message{m})
+	}()
+
+	return *chat, nil
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Last read commits are kept per branch in the repo config of the chat,
+// e.g. [gitogram "master"] lastRead = <hash>
+const configLastRead string = "lastRead"
+
+func getLastRead(r *git.Repository, branch string) plumbing.Hash {
+	cfg, err := r.Config()
+	if err != nil {
+		appConfig.LogErr(err, "reading repo config")
+		return plumbing.ZeroHash
+	}
+
+	return plumbing.NewHash(cfg.Raw.Section(configSection).Subsection(branch).Option(configLastRead))
+}
+
+func setLastRead(r *git.Repository, branch string, hash plumbing.Hash) error {
+	cfg, err := r.Config()
+	if err != nil {
+		appConfig.LogErr(err, "reading repo config")
+		return err
+	}
+
+	cfg.Raw.Section(configSection).Subsection(branch).SetOption(configLastRead, hash.String())
+
+	err = r.SetConfig(cfg)
+	if err != nil {
+		appConfig.LogErr(err, "writing repo config")
+		return err
+	}
+	return nil
+}
+
+// markRead saves HEAD as the last read commit of the checked out branch
+func markRead(r *git.Repository) (plumbing.Hash, error) {
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return plumbing.ZeroHash, err
+	}
+
+	return ref.Hash(), setLastRead(r, branch, ref.Hash())
+}
+
+// countUnread returns the number of messages in the checked out branch
+// after the last read commit, along with the commit. The branch never read
+// before is considered read up to HEAD
+func countUnread(r *git.Repository) (int, plumbing.Hash, error) {
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return 0, plumbing.ZeroHash, err
+	}
+
+	lastRead := getLastRead(r, branch)
+	if lastRead.IsZero() {
+		lastRead, err = markRead(r)
+		return 0, lastRead, err
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return 0, plumbing.ZeroHash, err
+	}
+
+	unread := 0
+	err = walkNewCommits(r, ref.Hash(), lastRead, func(c *object.Commit) error {
+		unread++
+		return nil
+	})
+	if err != nil {
+		return 0, plumbing.ZeroHash, err
+	}
+	return unread, lastRead, nil
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// pendingCommits returns the commits of the branch, which are not
+// on the remote branch yet, from the oldest one
+func pendingCommits(r *git.Repository, local, remote plumbing.Hash) ([]*object.Commit, error) {
+	unpushed := make(map[plumbing.Hash]bool)
+	err := walkNewCommits(r, local, remote, func(c *object.Commit) error {
+		unpushed[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages are sent one after another, so they are a line
+	var pending []*object.Commit
+	for hash := local; unpushed[hash]; {
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving commit %s", hash)
+			return nil, err
+		}
+		if c.NumParents() != 1 {
+			err = fmt.Errorf("commit %s has %d parents", c.Hash, c.NumParents())
+			appConfig.LogErr(err, "replaying pending commits")
+			return nil, err
+		}
+		pending = append(pending, c)
+		hash = c.ParentHashes[0]
+	}
+
+	if len(pending) != len(unpushed) {
+		err = fmt.Errorf("%d of %d pending commits are in line", len(pending), len(unpushed))
+		appConfig.LogErr(err, "replaying pending commits")
+		return nil, err
+	}
+
+	slices.Reverse(pending)
+	return pending, nil
+}
+
+// applyCommitFiles brings files changed by the commit, e.g. attachments,
+// into the worktree
+func applyCommitFiles(w *git.Worktree, c *object.Commit) error {
+	parent, err := c.Parent(0)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving parent of %s", c.Hash)
+		return err
+	}
+
+	parentTree, err := parent.Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tree of %s", parent.Hash)
+		return err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tree of %s", c.Hash)
+		return err
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		appConfig.LogErr(err, "diffing commit %s", c.Hash)
+		return err
+	}
+
+	for _, ch := range changes {
+		if ch.To.Name == "" {
+			if _, err := w.Remove(ch.From.Name); err != nil {
+				appConfig.LogDebug("File %s is already removed", ch.From.Name)
+			}
+			continue
+		}
+
+		f, err := tree.File(ch.To.Name)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving file %s", ch.To.Name)
+			return err
+		}
+
+		err = copyBlobToWorktree(w, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebasePending fetches the branch and puts my messages, which are not
+// pushed yet, after the ones somebody else pushed first. Replayed messages
+// keep their author time, the old commits are dropped. It reports whether
+// the branch was rebased
+func rebasePending(r *git.Repository, branch string, auth transport.AuthMethod) (bool, error) {
+	err := fetch(r, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return false, err
+	}
+	return rebaseOnRemote(r, branch)
+}
+
+// rebaseOnRemote is rebasePending over the remote branch fetched already
+func rebaseOnRemote(r *git.Repository, branch string) (bool, error) {
+	local, err := r.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving branch %s", branch)
+		return false, err
+	}
+
+	remote, err := r.Reference(remoteBranchRef(branch), true)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving remote branch %s", branch)
+		return false, err
+	}
+
+	pending, err := pendingCommits(r, local.Hash(), remote.Hash())
+	if err != nil {
+		return false, err
+	}
+
+	// Either I am up to date or the remote has all my messages already,
+	// e.g. the push went through but its answer got lost
+	behind := false
+	pushed := make(map[string]bool)
+	err = walkNewCommits(r, remote.Hash(), local.Hash(), func(c *object.Commit) error {
+		behind = true
+		if id := msgFromCommit(c).MsgId; id != "" {
+			pushed[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if !behind {
+		return false, nil
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return false, err
+	}
+
+	err = w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: remote.Hash()})
+	if err != nil {
+		appConfig.LogErr(err, "resetting %s to remote", branch)
+		return false, err
+	}
+
+	for _, c := range pending {
+		// The message got to the remote already, e.g. replayed by
+		// the push, which failed after the server took it
+		if id := msgFromCommit(c).MsgId; pushed[id] {
+			appConfig.LogDebug("Skip message %s pushed already", id)
+			continue
+		}
+
+		err = replayCommit(w, c)
+		if err != nil {
+			// Give the messages back, so they are not lost
+			w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: local.Hash()})
+			return false, err
+		}
+	}
+
+	appConfig.LogDebug("Rebase %d pending messages of %s", len(pending), branch)
+	return true, nil
+}
+
+func replayCommit(w *git.Worktree, c *object.Commit) error {
+	err := applyCommitFiles(w, c)
+	if err != nil {
+		return err
+	}
+
+	committer, err := commitAuthor()
+	if err != nil {
+		return err
+	}
+
+	author := c.Author
+	_, err = w.Commit(c.Message, &git.CommitOptions{
+		Author:            &author,
+		Committer:         committer,
+		Signer:            commitSigner(),
+		AllowEmptyCommits: true,
+	})
+	if err != nil {
+		appConfig.LogErr(err, "replaying commit %s", c.Hash)
+		return err
+	}
+	return nil
+}
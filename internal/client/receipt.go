@@ -0,0 +1,212 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Read receipts are refs pointing at the last commit each member read,
+// so they do not add commits to the chat. Every branch has its own
+// receipt, so reading a topic keeps what was read in the main chat
+const receiptsRefPrefix string = "refs/gitogram/read/"
+
+func receiptsRefSpec() config.RefSpec {
+	return config.RefSpec(fmt.Sprintf("+%s*:%s*", receiptsRefPrefix, receiptsRefPrefix))
+}
+
+// memberRefName returns the ref of the member under the prefix. Username
+// is escaped, as it may have spaces and other characters not allowed
+// in ref names
+func memberRefName(prefix, username string) plumbing.ReferenceName {
+	var b strings.Builder
+	for _, c := range []byte(username) {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return plumbing.ReferenceName(prefix + b.String())
+}
+
+// receiptRefName returns the read receipt of the member for the branch
+func receiptRefName(username, branch string) plumbing.ReferenceName {
+	return plumbing.ReferenceName(memberRefName(receiptsRefPrefix, username).String() + "/" + branch)
+}
+
+// refMember returns the username of the member ref under the prefix
+func refMember(prefix string, name plumbing.ReferenceName) (string, bool) {
+	escaped, ok := strings.CutPrefix(name.String(), prefix)
+	if !ok || strings.Contains(escaped, "/") {
+		return "", false
+	}
+
+	username, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", false
+	}
+	return username, true
+}
+
+// pushReceipt tells the others I read the checked out branch up to HEAD.
+// Receipts are not worth failing the caller, so errors are only logged
+func pushReceipt(r *git.Repository, auth transport.AuthMethod) {
+	username, err := GetUserName()
+	if err != nil {
+		return
+	}
+
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return
+	}
+
+	name := receiptRefName(username, branch)
+	err = r.Storer.SetReference(plumbing.NewHashReference(name, ref.Hash()))
+	if err != nil {
+		appConfig.LogErr(err, "updating read receipt")
+		return
+	}
+
+	// My pending messages get new hashes once sent, so it is forced
+	err = push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("+%s:%s", name, name)),
+	}})
+	if err != nil {
+		appConfig.LogErr(err, "pushing read receipt")
+	}
+}
+
+// getMemberRefs returns the commit of each member ref between
+// the prefix and the suffix
+func getMemberRefs(r *git.Repository, prefix, suffix string) map[string]plumbing.Hash {
+	hashes := make(map[string]plumbing.Hash)
+
+	refs, err := r.References()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving references")
+		return hashes
+	}
+
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		name, ok := strings.CutSuffix(ref.Name().String(), suffix)
+		if !ok {
+			return nil
+		}
+		if username, ok := refMember(prefix, plumbing.ReferenceName(name)); ok {
+			hashes[username] = ref.Hash()
+		}
+		return nil
+	})
+	return hashes
+}
+
+// getReceipts returns the last read commit of the branch by each member
+func getReceipts(r *git.Repository, branch string) map[string]plumbing.Hash {
+	return getMemberRefs(r, receiptsRefPrefix, "/"+branch)
+}
+
+// unseenCommits returns the commits of the checked out branch
+// each member has not read yet
+func unseenCommits(r *git.Repository) map[string]map[plumbing.Hash]bool {
+	unseen := make(map[string]map[plumbing.Hash]bool)
+
+	branch, err := getCurrBranch(r)
+	if err != nil {
+		return unseen
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return unseen
+	}
+
+	for username, read := range getReceipts(r, branch) {
+		commits := make(map[plumbing.Hash]bool)
+		err := walkNewCommits(r, ref.Hash(), read, func(c *object.Commit) error {
+			commits[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+		unseen[username] = commits
+	}
+	return unseen
+}
+
+// seenBy returns the members, who read the message, except its author
+func seenBy(unseen map[string]map[plumbing.Hash]bool, m Message) []string {
+	hash := plumbing.NewHash(m.Hash)
+
+	var usernames []string
+	for username, commits := range unseen {
+		if username != m.Author && !commits[hash] {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// addReceipts fills in the members, who read the messages
+func addReceipts(r *git.Repository, msgs []Message) {
+	unseen := unseenCommits(r)
+	for i := range msgs {
+		msgs[i].SeenBy = seenBy(unseen, msgs[i])
+	}
+}
+
+// lastOwnMsg returns my latest message in the checked out branch
+func lastOwnMsg(r *git.Repository) (Message, error) {
+	username, err := GetUserName()
+	if err != nil {
+		return Message{}, err
+	}
+
+	cIter, err := r.Log(&git.LogOptions{Order: git.LogOrderCommitterTime})
+	if err != nil {
+		appConfig.LogErr(err, "retrieving log")
+		return Message{}, err
+	}
+
+	var hash string
+	err = cIter.ForEach(func(c *object.Commit) error {
+		m := msgFromCommit(c)
+		if m.Author == username && followUpTarget(m) == "" && m.MergedTopic == "" {
+			hash = m.Hash
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over log")
+		return Message{}, err
+	}
+
+	if hash == "" {
+		return Message{}, plumbing.ErrObjectNotFound
+	}
+	return loadMsg(r, hash)
+}
@@ -0,0 +1,407 @@
+package client
+
+import (
+	"io"
+	"sync"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Role of the member is kept in info.json. Git servers know nothing about
+// it, so roles are enforced by the clients
+type Role string
+
+const (
+	RoleOwner    Role = "owner"
+	RoleAdmin    Role = "admin"
+	RoleMember   Role = "member"
+	RoleReadOnly Role = "read-only"
+)
+
+var roleRanks = map[Role]int{
+	RoleReadOnly: 1,
+	RoleMember:   2,
+	RoleAdmin:    3,
+	RoleOwner:    4,
+}
+
+// Roles lists the roles from the least permitted
+var Roles = []Role{RoleReadOnly, RoleMember, RoleAdmin, RoleOwner}
+
+type Permission int
+
+const (
+	// PermRead is granted to everyone, even to those, who are not members
+	PermRead Permission = iota
+	// PermWrite allows to send messages, react and manage topics
+	PermWrite
+	// PermModerate allows to retract messages of others, change roles
+	// and kick members
+	PermModerate
+)
+
+// RoleAllows reports whether the role has the permission
+func RoleAllows(role Role, p Permission) bool {
+	switch p {
+	case PermRead:
+		return true
+	case PermWrite:
+		return roleRanks[role] >= roleRanks[RoleMember]
+	case PermModerate:
+		return roleRanks[role] >= roleRanks[RoleAdmin]
+	}
+	return false
+}
+
+// memberRole returns the role of the member, or empty role if it is not
+// a member. Chats created before roles have the creator, who is the first
+// member, as the owner and everyone else as members
+func memberRole(members []chatMember, username string) Role {
+	hasOwner := false
+	for _, m := range members {
+		if m.Role == RoleOwner {
+			hasOwner = true
+		}
+	}
+
+	for i, m := range members {
+		if m.Username != username {
+			continue
+		}
+		switch {
+		case roleRanks[m.Role] > 0:
+			return m.Role
+		case i == 0 && !hasOwner:
+			return RoleOwner
+		default:
+			return RoleMember
+		}
+	}
+	return ""
+}
+
+// MemberRole returns the role of the member in the chat
+func MemberRole(c Chat, username string) Role {
+	return memberRole(c.Members, username)
+}
+
+// MyRole returns my role in the chat
+func MyRole(c Chat) Role {
+	username, err := GetUserName()
+	if err != nil {
+		return ""
+	}
+	return memberRole(c.Members, username)
+}
+
+// Allowed reports whether my role in the chat has the permission
+func Allowed(c Chat, p Permission) bool {
+	return RoleAllows(MyRole(c), p)
+}
+
+func checkPermission(c *Chat, p Permission) error {
+	if !Allowed(*c, p) {
+		appConfig.LogErr(ErrNotPermitted, "%s in %s", MyRole(*c), c.Name)
+		return ErrNotPermitted
+	}
+	return nil
+}
+
+// canManage reports whether the actor may change the role of the target
+// or kick it. Members are managed by those ranked above them only
+func canManage(actor, target Role) bool {
+	return RoleAllows(actor, PermModerate) && roleRanks[target] < roleRanks[actor]
+}
+
+// CanManage reports whether my role in the chat allows to change the role
+// of the member or kick it
+func CanManage(c Chat, username string) bool {
+	return canManage(MyRole(c), MemberRole(c, username))
+}
+
+// GivableRoles returns the roles I may give to the members of the chat
+func GivableRoles(c Chat) []Role {
+	myRole := MyRole(c)
+	var roles []Role
+	for _, role := range Roles {
+		if roleRanks[role] < roleRanks[myRole] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// allowedInfoChange reports whether the author may change info.json from
+// prev to next. Anyone with push access can commit info.json, so changes
+// are trusted only as far as the role of their author allows them
+func allowedInfoChange(prev, next ChatInfoJson, author string) bool {
+	authorRole := memberRole(prev.Members, author)
+	if next.Name != prev.Name && !RoleAllows(authorRole, PermModerate) {
+		return false
+	}
+
+	nextMembers := membersByName(next.Members)
+	for _, p := range prev.Members {
+		_, stays := nextMembers[p.Username]
+		if !stays && p.Username != author && !canManage(authorRole, memberRole(prev.Members, p.Username)) {
+			return false
+		}
+	}
+
+	prevMembers := membersByName(prev.Members)
+	for _, n := range next.Members {
+		role := memberRole(next.Members, n.Username)
+		p, ok := prevMembers[n.Username]
+		if !ok {
+			// Members join by themselves and not above a member
+			if n.Username != author || roleRanks[role] > roleRanks[RoleMember] {
+				return false
+			}
+			continue
+		}
+
+		prevRole := memberRole(prev.Members, n.Username)
+		if role != prevRole && (!canManage(authorRole, prevRole) || roleRanks[role] >= roleRanks[authorRole]) {
+			return false
+		}
+
+		if n.VisibleName != p.VisibleName && (n.Username != author || !RoleAllows(authorRole, PermWrite)) {
+			return false
+		}
+		if !n.Activity.Equal(p.Activity) && n.Username != author {
+			return false
+		}
+	}
+	return true
+}
+
+// infoCheckpoint is info.json checked up to the tip commit of the main branch
+type infoCheckpoint struct {
+	tip plumbing.Hash
+	// blob is info.json as it is committed in the tip, allowed or not
+	blob plumbing.Hash
+	info ChatInfoJson
+}
+
+// Checkpoints are kept by the path of the clone, so only new commits
+// of the main branch are checked next time
+var (
+	checkpointsMu sync.Mutex
+	checkpoints   = make(map[string]infoCheckpoint)
+)
+
+func repoRoot(r *git.Repository) string {
+	w, err := r.Worktree()
+	if err != nil {
+		return ""
+	}
+	return w.Filesystem.Root()
+}
+
+func infoBlob(c *object.Commit) (plumbing.Hash, bool) {
+	tree, err := c.Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tree of %s", c.Hash)
+		return plumbing.ZeroHash, false
+	}
+	entry, err := tree.FindEntry(infoFileName)
+	if err != nil {
+		return plumbing.ZeroHash, false
+	}
+	return entry.Hash, true
+}
+
+func readInfoBlob(r *git.Repository, hash plumbing.Hash) (ChatInfoJson, error) {
+	blob, err := r.BlobObject(hash)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving %s blob %s", infoFileName, hash)
+		return ChatInfoJson{}, err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		appConfig.LogErr(err, "reading %s blob %s", infoFileName, hash)
+		return ChatInfoJson{}, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		appConfig.LogErr(err, "reading %s blob %s", infoFileName, hash)
+		return ChatInfoJson{}, err
+	}
+	return parseChatInfo(data)
+}
+
+// checkedChatInfo replays the changes of info.json made along the main
+// branch up to the tip and skips the ones not allowed to their authors.
+// The first info.json creates the chat, so it is taken as is
+func checkedChatInfo(r *git.Repository, tip *object.Commit) (ChatInfoJson, error) {
+	root := repoRoot(r)
+	checkpointsMu.Lock()
+	cp, cached := checkpoints[root]
+	checkpointsMu.Unlock()
+	if root == "" {
+		cached = false
+	}
+	if cached && cp.tip == tip.Hash {
+		return cloneChatInfo(cp.info), nil
+	}
+
+	// Walk back to the checkpoint, or the first commit if it is not there,
+	// e.g. the branch was reset
+	var chain []*object.Commit
+	for c := tip; ; {
+		if cached && c.Hash == cp.tip {
+			break
+		}
+		chain = append(chain, c)
+		if c.NumParents() == 0 {
+			cp = infoCheckpoint{}
+			break
+		}
+
+		var err error
+		c, err = c.Parent(0)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving parent of %s", c.Hash)
+			return ChatInfoJson{}, err
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		c := chain[i]
+		cp.tip = c.Hash
+		blob, ok := infoBlob(c)
+		if !ok || blob == cp.blob {
+			continue
+		}
+
+		next, err := readInfoBlob(r, blob)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case cp.blob.IsZero():
+			cp.info = next
+		case allowedInfoChange(cp.info, next, c.Author.Name) && allowedKeyChange(cp.info, next, c):
+			cp.info = next
+		default:
+			appConfig.LogDebug("Skip %s change by %s in %s", infoFileName, c.Author.Name, c.Hash)
+		}
+		cp.blob = blob
+	}
+
+	if cp.blob.IsZero() {
+		appConfig.LogErr(object.ErrFileNotFound, "retrieving %s of %s", infoFileName, tip.Hash)
+		return ChatInfoJson{}, object.ErrFileNotFound
+	}
+
+	if root != "" {
+		checkpointsMu.Lock()
+		checkpoints[root] = cp
+		checkpointsMu.Unlock()
+	}
+	return cloneChatInfo(cp.info), nil
+}
+
+// mainChatInfo reads info.json of the main chat from the repo, so members
+// are known even when a topic is checked out. Only changes allowed to their
+// authors are taken into account
+func mainChatInfo(r *git.Repository) (ChatInfoJson, error) {
+	mainBranch, err := getMainBranch(r)
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+
+	c, err := getBranchCommit(r, mainBranch)
+	if err != nil {
+		return ChatInfoJson{}, err
+	}
+
+	return checkedChatInfo(r, c)
+}
+
+// moderators returns the members allowed to moderate messages
+func moderators(r *git.Repository) map[string]bool {
+	mods := make(map[string]bool)
+
+	info, err := mainChatInfo(r)
+	if err != nil {
+		return mods
+	}
+
+	for _, m := range info.Members {
+		if RoleAllows(memberRole(info.Members, m.Username), PermModerate) {
+			mods[m.Username] = true
+		}
+	}
+	return mods
+}
+
+// SetMemberRole gives the member of the current chat a new role.
+// Only roles below mine can be given and only to members below me
+func SetMemberRole(username string, role Role) (Chat, error) {
+	if roleRanks[role] == 0 {
+		appConfig.LogErr(ErrNotPermitted, "unknown role %s", role)
+		return Chat{}, ErrNotPermitted
+	}
+
+	return changeChatInfo(func(info *ChatInfoJson, me string) error {
+		myRole := memberRole(info.Members, me)
+		target := memberRole(info.Members, username)
+		if target == "" {
+			appConfig.LogErr(ErrMemberNotFound, "%s", username)
+			return ErrMemberNotFound
+		}
+		if !canManage(myRole, target) || roleRanks[role] >= roleRanks[myRole] {
+			appConfig.LogErr(ErrNotPermitted, "%s giving %s to %s", myRole, role, username)
+			return ErrNotPermitted
+		}
+
+		for i := range info.Members {
+			// Roles of the chats created before roles are written down
+			info.Members[i].Role = memberRole(info.Members, info.Members[i].Username)
+		}
+		for i := range info.Members {
+			if info.Members[i].Username == username {
+				info.Members[i].Role = role
+			}
+		}
+		appConfig.LogDebug("Give %s role %s", username, role)
+		return nil
+	})
+}
+
+// KickMember takes the member out of the current chat
+func KickMember(username string) (Chat, error) {
+	return changeChatInfo(func(info *ChatInfoJson, me string) error {
+		myRole := memberRole(info.Members, me)
+		target := memberRole(info.Members, username)
+		if target == "" {
+			appConfig.LogErr(ErrMemberNotFound, "%s", username)
+			return ErrMemberNotFound
+		}
+		if !canManage(myRole, target) {
+			appConfig.LogErr(ErrNotPermitted, "%s kicking %s", myRole, username)
+			return ErrNotPermitted
+		}
+
+		var members []chatMember
+		for _, m := range info.Members {
+			if m.Username != username {
+				m.Role = memberRole(info.Members, m.Username)
+				members = append(members, m)
+			}
+		}
+		info.Members = members
+		info.MembersNum = len(members)
+		appConfig.LogDebug("Kick %s", username)
+		return nil
+	})
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// SearchHit is a message found by Search
+type SearchHit struct {
+	Chat    Chat
+	Topic   string
+	Msg     Message
+	Context string
+}
+
+type searchQuery struct {
+	re     *regexp.Regexp
+	author string
+	chat   string
+	before time.Time
+	after  time.Time
+}
+
+var searchDateLayouts = []string{"2006-01-02", "02.01.2006"}
+
+func parseSearchDate(s string) (time.Time, error) {
+	for _, layout := range searchDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: bad date %s", ErrInvalidQuery, s)
+}
+
+// parseSearchQuery splits the query into filters, e.g. "author:alice",
+// "chat:demo", "before:2026-10-01", "after:01.09.2026", and the rest of
+// words, which is a case-insensitive regular expression
+func parseSearchQuery(query string) (searchQuery, error) {
+	var q searchQuery
+	var words []string
+	for _, word := range strings.Fields(query) {
+		key, value, _ := strings.Cut(word, ":")
+		var err error
+		switch key {
+		case "author":
+			q.author = value
+		case "chat":
+			q.chat = value
+		case "before":
+			q.before, err = parseSearchDate(value)
+		case "after":
+			q.after, err = parseSearchDate(value)
+		default:
+			words = append(words, word)
+		}
+		if err != nil {
+			return searchQuery{}, err
+		}
+	}
+
+	if len(words) > 0 {
+		re, err := regexp.Compile("(?i)" + strings.Join(words, " "))
+		if err != nil {
+			return searchQuery{}, fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+		}
+		q.re = re
+	}
+	return q, nil
+}
+
+func (q searchQuery) matchChat(c *Chat) bool {
+	return q.chat == "" || strings.Contains(strings.ToLower(c.Name), strings.ToLower(q.chat))
+}
+
+// match reports whether the message passes the filters
+// and returns the line of the text around the match
+func (q searchQuery) match(m Message) (string, bool) {
+	if m.Deleted {
+		return "", false
+	}
+	if q.author != "" && !strings.EqualFold(m.Author, q.author) {
+		return "", false
+	}
+	if !q.before.IsZero() && !m.Time.Before(q.before) {
+		return "", false
+	}
+	// Messages of the "after" day are included
+	if !q.after.IsZero() && m.Time.Before(q.after) {
+		return "", false
+	}
+
+	text := m.Text
+	if text == "" {
+		text = AttachmentName(m)
+	}
+	if q.re == nil {
+		return strings.SplitN(text, "\n", 2)[0], true
+	}
+
+	loc := q.re.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+	return searchContext(text, loc[0], loc[1]), true
+}
+
+const searchContextLen int = 30
+
+// searchContext returns the line with the match, cut to some
+// characters around it
+func searchContext(text string, start, end int) string {
+	lineStart := strings.LastIndex(text[:start], "\n") + 1
+	lineEnd := len(text)
+	if i := strings.Index(text[end:], "\n"); i >= 0 {
+		lineEnd = end + i
+	}
+
+	from := max(lineStart, start-searchContextLen)
+	to := min(lineEnd, end+searchContextLen)
+	// Do not cut multibyte characters in half
+	for from > lineStart && !isRuneStart(text[from]) {
+		from--
+	}
+	for to < lineEnd && !isRuneStart(text[to]) {
+		to++
+	}
+
+	context := text[from:to]
+	if from > lineStart {
+		context = "…" + context
+	}
+	if to < lineEnd {
+		context += "…"
+	}
+	return context
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// branchMsgs returns the messages of the branch up to its tip,
+// the most recent first
+func branchMsgs(r *git.Repository, tip plumbing.Hash) ([]Message, error) {
+	cIter, err := r.Log(&git.LogOptions{From: tip, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		appConfig.LogErr(err, "retrieving log of %s", tip)
+		return nil, err
+	}
+
+	var msgs []Message
+	err = cIter.ForEach(func(c *object.Commit) error {
+		msgs = append(msgs, msgFromCommit(c))
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over log of %s", tip)
+		return nil, err
+	}
+
+	// The whole history is here, so there is nothing to resolve
+	return foldMsgs(msgs, moderators(r), func(hash string) (Message, error) {
+		return Message{}, plumbing.ErrObjectNotFound
+	}), nil
+}
+
+// searchChat looks for the messages in the main branch and topics
+// of the chat. Messages of the main branch are found only once,
+// even though topics share them
+func searchChat(c *Chat, q searchQuery) ([]SearchHit, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := openChatRepo(c)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []string{c.mainBranch}
+	refs, err := repo.References()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving references")
+		return nil, err
+	}
+
+	remotePrefix := git.DefaultRemoteName + "/"
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if !ref.Name().IsRemote() || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		name := strings.TrimPrefix(ref.Name().Short(), remotePrefix)
+		if name != c.mainBranch && name != plumbing.HEAD.String() {
+			branches = append(branches, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []SearchHit
+	seen := make(map[string]bool)
+	for _, branch := range branches {
+		tip, err := getBranchCommit(repo, branch)
+		if err != nil {
+			continue
+		}
+
+		msgs, err := branchMsgs(repo, tip.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		topic := branch
+		if branch == c.mainBranch {
+			topic = ""
+		}
+
+		for _, m := range msgs {
+			if seen[m.Hash] {
+				continue
+			}
+			seen[m.Hash] = true
+
+			if context, ok := q.match(m); ok {
+				hits = append(hits, SearchHit{Chat: *c, Topic: topic, Msg: m, Context: context})
+			}
+		}
+	}
+	return hits, nil
+}
+
+// Search looks for the messages in all chats, including their topics.
+// Besides a regular expression the query takes filters, e.g.
+// "author:alice chat:demo after:2026-09-01 before:01.10.2026 deploy|release".
+// Hits come from the most recent ones
+func Search(query string) ([]SearchHit, error) {
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		appConfig.LogErr(err, "parsing search query %s", query)
+		return nil, err
+	}
+
+	var hits []SearchHit
+	for _, c := range listChats() {
+		if !q.matchChat(c) {
+			continue
+		}
+
+		chatHits, err := searchChat(c, q)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, chatHits...)
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Msg.Time.After(hits[j].Msg.Time)
+	})
+	appConfig.LogDebug("Found %d messages for %s", len(hits), query)
+	return hits, nil
+}
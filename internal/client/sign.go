@@ -0,0 +1,513 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Messages are signed the way git signs commits: commit.gpgSign turns
+// signing on, gpg.format picks ssh or openpgp and user.signingKey is
+// the key file. Public keys of members are kept in info.json, so every
+// member verifies the messages with the same keys
+
+const (
+	signFormatOpenPGP = "openpgp"
+	signFormatSSH     = "ssh"
+)
+
+type SignatureState int
+
+const (
+	// SignatureNone is of the messages, which are not signed
+	SignatureNone SignatureState = iota
+	// SignatureUnverified is of the messages signed by a key,
+	// which is not a key of any member
+	SignatureUnverified
+	// SignatureVerified is of the messages signed by a key of a member
+	SignatureVerified
+)
+
+func (s SignatureState) String() string {
+	switch s {
+	case SignatureUnverified:
+		return "unverified"
+	case SignatureVerified:
+		return "verified"
+	default:
+		return "unsigned"
+	}
+}
+
+// signingKey signs my commits
+type signingKey interface {
+	git.Signer
+	// publicKey returns the key to verify the signatures with,
+	// as it is kept in info.json
+	publicKey() (string, error)
+}
+
+// expandHome resolves ~ the way git does for user.signingKey
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		appConfig.LogErr(err, "getting home dir")
+		return "", err
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
+
+// loadSigningKey returns the key to sign my commits with,
+// or nil if signing is off
+func loadSigningKey() (signingKey, error) {
+	cfg, err := getGitConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(cfg.Raw.Section("commit").Option("gpgsign"), "true") {
+		return nil, nil
+	}
+
+	keyPath, err := expandHome(cfg.Raw.Section("user").Option("signingkey"))
+	if err != nil {
+		return nil, err
+	}
+	if keyPath == "" {
+		appConfig.LogErr(ErrSigningKey, "user.signingKey is not set")
+		return nil, ErrSigningKey
+	}
+
+	format := cfg.Raw.Section("gpg").Option("format")
+	switch format {
+	case signFormatSSH:
+		return loadSSHKey(keyPath)
+	case signFormatOpenPGP, "":
+		return loadPGPKey(keyPath)
+	default:
+		err = fmt.Errorf("%w: unsupported gpg.format %s", ErrSigningKey, format)
+		appConfig.LogErr(err, "loading signing key")
+		return nil, err
+	}
+}
+
+// commitSigner returns the signer of my commits, or nil if signing is off.
+// Commits go unsigned, if the key cannot be loaded
+func commitSigner() git.Signer {
+	key, err := loadSigningKey()
+	if err != nil || key == nil {
+		return nil
+	}
+	return key
+}
+
+// myPublicKey returns my public key to keep in info.json,
+// or an empty string if signing is off
+func myPublicKey() string {
+	key, err := loadSigningKey()
+	if err != nil || key == nil {
+		return ""
+	}
+
+	pub, err := key.publicKey()
+	if err != nil {
+		return ""
+	}
+	return pub
+}
+
+// SSH signatures follow the SSHSIG format of OpenSSH, which is what
+// git writes and checks with ssh-keygen -Y
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigVersion   = 1
+	sshSigNamespace = "git"
+	sshSigHashAlg   = "sha512"
+	sshSigBegin     = "-----BEGIN SSH SIGNATURE-----"
+	sshSigEnd       = "-----END SSH SIGNATURE-----"
+	sshSigLineLen   = 70
+)
+
+// sshSigBlob is the signature blob without the magic preamble
+type sshSigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature []byte
+}
+
+// sshSignedData is what the key signs instead of the message itself
+type sshSignedData struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+func sshSigPayload(message io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+
+	data := ssh.Marshal(sshSignedData{
+		Namespace: sshSigNamespace,
+		HashAlg:   sshSigHashAlg,
+		Hash:      h.Sum(nil),
+	})
+	return append([]byte(sshSigMagic), data...), nil
+}
+
+type sshKey struct {
+	signer ssh.Signer
+}
+
+func loadSSHKey(keyPath string) (signingKey, error) {
+	// git takes the public key, the private one is next to it
+	data, err := os.ReadFile(strings.TrimSuffix(keyPath, ".pub"))
+	if err != nil {
+		appConfig.LogErr(err, "reading signing key %s", keyPath)
+		return nil, fmt.Errorf("%w: %w", ErrSigningKey, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		appConfig.LogErr(err, "parsing signing key %s", keyPath)
+		return nil, fmt.Errorf("%w: %w", ErrSigningKey, err)
+	}
+	return sshKey{signer: signer}, nil
+}
+
+func (k sshKey) Sign(message io.Reader) ([]byte, error) {
+	payload, err := sshSigPayload(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig *ssh.Signature
+	algSigner, ok := k.signer.(ssh.AlgorithmSigner)
+	if ok && k.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures are refused by ssh-keygen
+		sig, err = algSigner.SignWithAlgorithm(rand.Reader, payload, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = k.signer.Sign(rand.Reader, payload)
+	}
+	if err != nil {
+		appConfig.LogErr(err, "signing commit")
+		return nil, err
+	}
+
+	blob := ssh.Marshal(sshSigBlob{
+		Version:   sshSigVersion,
+		PublicKey: k.signer.PublicKey().Marshal(),
+		Namespace: sshSigNamespace,
+		HashAlg:   sshSigHashAlg,
+		Signature: ssh.Marshal(sig),
+	})
+	return armorSSHSig(append([]byte(sshSigMagic), blob...)), nil
+}
+
+func (k sshKey) publicKey() (string, error) {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.signer.PublicKey()))), nil
+}
+
+func armorSSHSig(blob []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	var b bytes.Buffer
+	b.WriteString(sshSigBegin + "\n")
+	for len(encoded) > sshSigLineLen {
+		b.WriteString(encoded[:sshSigLineLen] + "\n")
+		encoded = encoded[sshSigLineLen:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString(sshSigEnd + "\n")
+	return b.Bytes()
+}
+
+// verifySSHSig checks the SSH signature of the message and returns
+// the key, which made it
+func verifySSHSig(message io.Reader, armored string) (ssh.PublicKey, error) {
+	body := strings.TrimSpace(armored)
+	if !strings.HasPrefix(body, sshSigBegin) || !strings.HasSuffix(body, sshSigEnd) {
+		return nil, errors.New("not an ssh signature")
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, sshSigBegin), sshSigEnd)
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := bytes.CutPrefix(data, []byte(sshSigMagic))
+	if !ok {
+		return nil, errors.New("missing ssh signature preamble")
+	}
+
+	var blob sshSigBlob
+	if err := ssh.Unmarshal(data, &blob); err != nil {
+		return nil, err
+	}
+	if blob.Version != sshSigVersion || blob.Namespace != sshSigNamespace || blob.HashAlg != sshSigHashAlg {
+		return nil, fmt.Errorf("unsupported ssh signature %d %s %s", blob.Version, blob.Namespace, blob.HashAlg)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := sshSigPayload(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pub.Verify(payload, &sig); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+type pgpKey struct {
+	entity *openpgp.Entity
+}
+
+// loadPGPKey reads the armored secret key. Keys in the keyring of gpg
+// are out of reach, so user.signingKey is the path to the exported key
+func loadPGPKey(keyPath string) (signingKey, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		appConfig.LogErr(err, "opening signing key %s", keyPath)
+		return nil, fmt.Errorf("%w: %w", ErrSigningKey, err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		appConfig.LogErr(err, "parsing signing key %s", keyPath)
+		return nil, fmt.Errorf("%w: %w", ErrSigningKey, err)
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			err = fmt.Errorf("%w: %s is protected by passphrase", ErrSigningKey, keyPath)
+			appConfig.LogErr(err, "loading signing key")
+			return nil, err
+		}
+		return pgpKey{entity: e}, nil
+	}
+
+	err = fmt.Errorf("%w: no secret key in %s", ErrSigningKey, keyPath)
+	appConfig.LogErr(err, "loading signing key")
+	return nil, err
+}
+
+func (k pgpKey) Sign(message io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	err := openpgp.ArmoredDetachSign(&b, k.entity, message, nil)
+	if err != nil {
+		appConfig.LogErr(err, "signing commit")
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (k pgpKey) publicKey() (string, error) {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := k.entity.Serialize(w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func isSSHKey(key string) bool {
+	return !strings.HasPrefix(key, "-----BEGIN PGP")
+}
+
+// verifyCommit checks the signature of the commit against keys of
+// the members and returns the member, whose key made it
+func verifyCommit(c *object.Commit, members []chatMember) (SignatureState, string) {
+	if c.PGPSignature == "" {
+		return SignatureNone, ""
+	}
+
+	if strings.HasPrefix(c.PGPSignature, sshSigBegin) {
+		encoded := &plumbing.MemoryObject{}
+		if err := c.EncodeWithoutSignature(encoded); err != nil {
+			return SignatureUnverified, ""
+		}
+		reader, err := encoded.Reader()
+		if err != nil {
+			return SignatureUnverified, ""
+		}
+
+		pub, err := verifySSHSig(reader, c.PGPSignature)
+		if err != nil {
+			appConfig.LogDebug("Bad signature of %s: %s", c.Hash, err)
+			return SignatureUnverified, ""
+		}
+
+		for _, m := range members {
+			if m.SigningKey == "" || !isSSHKey(m.SigningKey) {
+				continue
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(m.SigningKey))
+			if err == nil && bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return SignatureVerified, m.Username
+			}
+		}
+		return SignatureUnverified, ""
+	}
+
+	for _, m := range members {
+		if m.SigningKey == "" || isSSHKey(m.SigningKey) {
+			continue
+		}
+		if _, err := c.Verify(m.SigningKey); err == nil {
+			return SignatureVerified, m.Username
+		}
+	}
+	return SignatureUnverified, ""
+}
+
+// addSignatures checks signatures of the messages against keys of
+// the members kept in info.json of the main branch
+func addSignatures(r *git.Repository, msgs []Message) {
+	var members []chatMember
+	for i := range msgs {
+		if msgs[i].Signature == SignatureNone {
+			continue
+		}
+
+		if members == nil {
+			info, err := mainChatInfo(r)
+			if err != nil {
+				return
+			}
+			members = info.Members
+		}
+
+		c, err := r.CommitObject(plumbing.NewHash(msgs[i].Hash))
+		if err != nil {
+			appConfig.LogErr(err, "retrieving message %s", msgs[i].Hash)
+			continue
+		}
+		msgs[i].Signature, msgs[i].Signer = verifyCommit(c, members)
+	}
+}
+
+// allowedKeyChange reports whether the commit may change signing keys of
+// members from prev to next. Members publish only their own key and only
+// once, so the first published key is the one trusted. Once a member has
+// a key, changes of info.json in its name have to be signed with it
+func allowedKeyChange(prev, next ChatInfoJson, c *object.Commit) bool {
+	prevMembers := membersByName(prev.Members)
+	if author, ok := prevMembers[c.Author.Name]; ok && author.SigningKey != "" {
+		state, signer := verifyCommit(c, []chatMember{author})
+		if state != SignatureVerified || signer != author.Username {
+			return false
+		}
+	}
+
+	for _, n := range next.Members {
+		p := prevMembers[n.Username]
+		if n.SigningKey == p.SigningKey {
+			continue
+		}
+		if n.Username != c.Author.Name || p.SigningKey != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// CanPublishSigningKey reports whether I sign messages, but have not
+// published my key to the chat yet
+func CanPublishSigningKey(c Chat) bool {
+	username, err := GetUserName()
+	if err != nil {
+		return false
+	}
+
+	for _, m := range c.Members {
+		if m.Username == username {
+			return m.SigningKey == "" && myPublicKey() != ""
+		}
+	}
+	return false
+}
+
+// PublishSigningKey puts my public key into info.json of the current chat,
+// so the members verify my messages with it. The key is published once:
+// to replace it, I have to be kicked and join the chat again
+func PublishSigningKey() (Chat, error) {
+	key, err := loadSigningKey()
+	if err != nil {
+		return Chat{}, err
+	}
+	if key == nil {
+		appConfig.LogErr(ErrSigningKey, "commit.gpgSign is off")
+		return Chat{}, ErrSigningKey
+	}
+
+	pub, err := key.publicKey()
+	if err != nil {
+		appConfig.LogErr(err, "encoding public key")
+		return Chat{}, err
+	}
+
+	return changeChatInfo(func(info *ChatInfoJson, me string) error {
+		for i := range info.Members {
+			if info.Members[i].Username != me {
+				continue
+			}
+			if info.Members[i].SigningKey != "" {
+				appConfig.LogErr(ErrKeyPublished, "%s", me)
+				return ErrKeyPublished
+			}
+			info.Members[i].SigningKey = pub
+			appConfig.LogDebug("Publish signing key of %s", me)
+			return nil
+		}
+		appConfig.LogErr(ErrMemberNotFound, "%s", me)
+		return ErrMemberNotFound
+	})
+}
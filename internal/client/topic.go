@@ -0,0 +1,1078 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IlorDash/gitogram/internal/appConfig"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Topic is a side discussion inside a chat, stored as a branch
+// forked from the chat's main branch
+type Topic struct {
+	Name    string
+	MsgNum  int
+	LastMsg Message
+}
+
+const defaultMainBranch string = "master"
+
+const configSection string = "gitogram"
+const configMainBranch string = "mainBranch"
+
+var topicNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+func setMainBranch(r *git.Repository, branch string) error {
+	cfg, err := r.Config()
+	if err != nil {
+		appConfig.LogErr(err, "reading repo config")
+		return err
+	}
+
+	cfg.Raw.Section(configSection).SetOption(configMainBranch, branch)
+
+	err = r.SetConfig(cfg)
+	if err != nil {
+		appConfig.LogErr(err, "writing repo config")
+		return err
+	}
+	return nil
+}
+
+// getMainBranch returns the branch the chat was cloned with. It is saved in
+// the repo config, because HEAD may point to a topic later on
+func getMainBranch(r *git.Repository) (string, error) {
+	cfg, err := r.Config()
+	if err != nil {
+		appConfig.LogErr(err, "reading repo config")
+		return "", err
+	}
+
+	branch := cfg.Raw.Section(configSection).Option(configMainBranch)
+	if branch != "" {
+		return branch, nil
+	}
+
+	branch, err = getCurrBranch(r)
+	if err != nil {
+		return "", err
+	}
+
+	return branch, setMainBranch(r, branch)
+}
+
+func getCurrBranch(r *git.Repository) (string, error) {
+	head, err := r.Reference(plumbing.HEAD, false)
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return "", err
+	}
+
+	if head.Type() != plumbing.SymbolicReference {
+		err = fmt.Errorf("detached HEAD at %s", head.Hash())
+		appConfig.LogErr(err, "retrieving current branch")
+		return "", err
+	}
+	return head.Target().Short(), nil
+}
+
+func branchRefSpec(branch string) config.RefSpec {
+	ref := plumbing.NewBranchReferenceName(branch)
+	return config.RefSpec(fmt.Sprintf("%s:%s", ref, ref))
+}
+
+func remoteBranchRef(branch string) plumbing.ReferenceName {
+	return plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch)
+}
+
+// checkoutBranch switches the worktree to the local branch, creating it from
+// the remote one if it was never checked out before
+func checkoutBranch(r *git.Repository, branch string) error {
+	curr, err := getCurrBranch(r)
+	if err == nil && curr == branch {
+		return nil
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return err
+	}
+
+	localRef := plumbing.NewBranchReferenceName(branch)
+	_, err = r.Reference(localRef, false)
+	if err == plumbing.ErrReferenceNotFound {
+		remoteRef, err := r.Reference(remoteBranchRef(branch), true)
+		if err != nil {
+			appConfig.LogErr(err, "no remote branch %s", branch)
+			return ErrTopicNotFound
+		}
+
+		err = r.Storer.SetReference(plumbing.NewHashReference(localRef, remoteRef.Hash()))
+		if err != nil {
+			appConfig.LogErr(err, "creating branch %s", branch)
+			return err
+		}
+	} else if err != nil {
+		appConfig.LogErr(err, "retrieving branch %s", branch)
+		return err
+	}
+
+	err = w.Checkout(&git.CheckoutOptions{Branch: localRef})
+	if err != nil {
+		appConfig.LogErr(err, "checking out %s", branch)
+		return err
+	}
+	return nil
+}
+
+func getBranchCommit(r *git.Repository, branch string) (*object.Commit, error) {
+	ref, err := r.Reference(remoteBranchRef(branch), true)
+	if err != nil {
+		ref, err = r.Reference(plumbing.NewBranchReferenceName(branch), true)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving branch %s", branch)
+			return nil, err
+		}
+	}
+
+	c, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit of branch %s", branch)
+		return nil, err
+	}
+	return c, nil
+}
+
+// getTopicCommits returns the commits of the topic that are not in the main
+// branch, the most recent first
+func getTopicCommits(tip, main *object.Commit) ([]*object.Commit, error) {
+	bases, err := tip.MergeBase(main)
+	if err != nil {
+		appConfig.LogErr(err, "finding merge base of %s", tip.Hash)
+		return nil, err
+	}
+
+	var ignore []plumbing.Hash
+	for _, b := range bases {
+		ignore = append(ignore, b.Hash)
+	}
+
+	var commits []*object.Commit
+	err = object.NewCommitPreorderIter(tip, nil, ignore).ForEach(func(c *object.Commit) error {
+		commits = append(commits, c)
+		return nil
+	})
+	if err != nil {
+		appConfig.LogErr(err, "iterating over topic %s", tip.Hash)
+		return nil, err
+	}
+	return commits, nil
+}
+
+func openChatRepo(c *Chat) (*git.Repository, error) {
+	chatPath, err := getChatPath(c.Url.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(chatPath)
+	if err != nil {
+		appConfig.LogErr(err, "openning repo %s", chatPath)
+		return nil, err
+	}
+	return repo, nil
+}
+
+func ListTopics(chat Chat) ([]Topic, error) {
+	c := findChatInList(chat)
+	if c == nil {
+		return nil, fmt.Errorf("chat %s not found", chat.Name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := openChatRepo(c)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := getAuth(c.username, c.password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetch(repo, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth, Prune: true})
+	if err != nil {
+		return nil, err
+	}
+
+	mainCommit, err := getBranchCommit(repo, c.mainBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving references")
+		return nil, err
+	}
+
+	remotePrefix := git.DefaultRemoteName + "/"
+	var topics []Topic
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if !ref.Name().IsRemote() || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		name := strings.TrimPrefix(ref.Name().Short(), remotePrefix)
+		if name == c.mainBranch || name == plumbing.HEAD.String() {
+			return nil
+		}
+
+		tip, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			appConfig.LogErr(err, "retrieving commit of topic %s", name)
+			return err
+		}
+
+		commits, err := getTopicCommits(tip, mainCommit)
+		if err != nil {
+			return err
+		}
+
+		topics = append(topics, Topic{
+			Name:    name,
+			MsgNum:  len(commits),
+			LastMsg: msgFromCommit(tip),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].LastMsg.Time.After(topics[j].LastMsg.Time)
+	})
+	return topics, nil
+}
+
+// CreateTopic forks a new topic from the main branch of the current chat
+// and publishes it
+func CreateTopic(name string) (Topic, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Topic{}, ErrCurrChatNil
+	}
+
+	if !topicNameRe.MatchString(name) || name == plumbing.HEAD.String() {
+		appConfig.LogErr(ErrInvalidTopicName, "topic %s", name)
+		return Topic{}, ErrInvalidTopicName
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	if err := checkPermission(chat, PermWrite); err != nil {
+		return Topic{}, err
+	}
+
+	if name == chat.mainBranch {
+		appConfig.LogErr(ErrInvalidTopicName, "topic %s is the main branch", name)
+		return Topic{}, ErrInvalidTopicName
+	}
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	auth, err := getAuth(chat.username, chat.password)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	err = fetch(repo, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return Topic{}, err
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(name)
+	_, remoteErr := repo.Reference(remoteBranchRef(name), false)
+	_, localErr := repo.Reference(branchRef, false)
+	if remoteErr == nil || localErr == nil {
+		appConfig.LogErr(ErrTopicExists, "topic %s", name)
+		return Topic{}, ErrTopicExists
+	}
+
+	base, err := getBranchCommit(repo, chat.mainBranch)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference(branchRef, base.Hash))
+	if err != nil {
+		appConfig.LogErr(err, "creating branch %s", name)
+		return Topic{}, err
+	}
+
+	err = push(repo, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(name)}})
+	if err != nil {
+		repo.Storer.RemoveReference(branchRef)
+		return Topic{}, err
+	}
+	appConfig.LogDebug("Create topic %s in %s", name, chat.Name)
+
+	return Topic{Name: name, MsgNum: 0, LastMsg: msgFromCommit(base)}, nil
+}
+
+// SwitchTopic checks out the topic in the current chat and reloads its
+// messages. Empty name switches back to the main chat
+func SwitchTopic(name string) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	err := func() error {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+
+		repo, err := openChatRepo(chat)
+		if err != nil {
+			return err
+		}
+
+		branch := name
+		if branch == "" {
+			branch = chat.mainBranch
+		}
+
+		err = checkoutBranch(repo, branch)
+		if err != nil {
+			return err
+		}
+
+		if branch == chat.mainBranch {
+			chat.Topic = ""
+		} else {
+			chat.Topic = branch
+		}
+		appConfig.LogDebug("Switch %s to topic %s", chat.Name, branch)
+		return nil
+	}()
+	if err != nil {
+		return Chat{}, err
+	}
+
+	return SelectChat(*chat)
+}
+
+const pushRetries int = 3
+
+const retryDelay time.Duration = 500 * time.Millisecond
+
+func deleteBranchRefSpec(branch string) config.RefSpec {
+	return config.RefSpec(":" + plumbing.NewBranchReferenceName(branch).String())
+}
+
+func participants(commits []*object.Commit) []string {
+	var names []string
+	seen := make(map[string]bool)
+	// Commits come from the most recent ones, so go in reverse order
+	for i := len(commits) - 1; i >= 0; i-- {
+		name := commits[i].Author.Name
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// topicSummary describes who discussed the topic and when, e.g.
+// "3 messages by alice, bob from 16.10.2026 10:00 to 16.10.2026 12:30"
+func topicSummary(commits []*object.Commit) string {
+	if len(commits) == 0 {
+		return "No messages"
+	}
+
+	const layout = "02.01.2006 15:04"
+	first := commits[len(commits)-1].Author.When
+	last := commits[0].Author.When
+
+	return fmt.Sprintf("%d messages by %s from %s to %s", len(commits),
+		strings.Join(participants(commits), ", "), first.Format(layout), last.Format(layout))
+}
+
+func mergeMsg(name string, commits []*object.Commit) string {
+	opening := msgFromCommit(commits[len(commits)-1])
+	text := fmt.Sprintf("Merge topic %s\n\n%s\nStarted by %s: %s",
+		name, topicSummary(commits), opening.Author, strings.SplitN(opening.Text, "\n", 2)[0])
+	return withTrailers(text, trailer{trailerTopicMerged, name})
+}
+
+// applyTopicFiles brings files changed in the topic, e.g. attachments,
+// into the worktree of the main branch
+func applyTopicFiles(w *git.Worktree, main, tip *object.Commit) error {
+	bases, err := tip.MergeBase(main)
+	if err != nil || len(bases) == 0 {
+		appConfig.LogErr(err, "finding merge base of %s", tip.Hash)
+		return errors.New("no merge base")
+	}
+
+	baseTree, err := bases[0].Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tree of %s", bases[0].Hash)
+		return err
+	}
+
+	tipTree, err := tip.Tree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tree of %s", tip.Hash)
+		return err
+	}
+
+	changes, err := object.DiffTree(baseTree, tipTree)
+	if err != nil {
+		appConfig.LogErr(err, "diffing topic %s", tip.Hash)
+		return err
+	}
+
+	for _, ch := range changes {
+		if ch.To.Name == "" {
+			if _, err := w.Remove(ch.From.Name); err != nil {
+				appConfig.LogDebug("File %s is already removed", ch.From.Name)
+			}
+			continue
+		}
+
+		f, err := tipTree.File(ch.To.Name)
+		if err != nil {
+			appConfig.LogErr(err, "retrieving file %s", ch.To.Name)
+			return err
+		}
+
+		err = copyBlobToWorktree(w, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyBlobToWorktree(w *git.Worktree, f *object.File) error {
+	src, err := f.Reader()
+	if err != nil {
+		appConfig.LogErr(err, "reading file %s", f.Name)
+		return err
+	}
+	defer src.Close()
+
+	dst, err := w.Filesystem.Create(f.Name)
+	if err != nil {
+		appConfig.LogErr(err, "creating file %s", f.Name)
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		appConfig.LogErr(err, "writing file %s", f.Name)
+		return err
+	}
+
+	_, err = w.Add(f.Name)
+	if err != nil {
+		appConfig.LogErr(err, "staging %s", f.Name)
+		return err
+	}
+	return nil
+}
+
+// topicOnMain checks out the up to date main branch and returns it along
+// with the topic tip and the topic commits not yet in the main branch
+func topicOnMain(r *git.Repository, c *Chat, name string, auth transport.AuthMethod) (*object.Commit, *object.Commit, []*object.Commit, error) {
+	err := fetch(r, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = checkoutBranch(r, c.mainBranch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, err = pullMsgs(r, plumbing.ZeroHash, &git.PullOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving HEAD")
+		return nil, nil, nil, err
+	}
+
+	main, err := r.CommitObject(head.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit")
+		return nil, nil, nil, err
+	}
+
+	tipRef, err := r.Reference(remoteBranchRef(name), true)
+	if err != nil {
+		appConfig.LogErr(err, "no remote topic %s", name)
+		return nil, nil, nil, ErrTopicNotFound
+	}
+
+	tip, err := r.CommitObject(tipRef.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit of topic %s", name)
+		return nil, nil, nil, err
+	}
+
+	commits, err := getTopicCommits(tip, main)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(commits) == 0 {
+		appConfig.LogErr(ErrNothingToMerge, "topic %s", name)
+		return nil, nil, nil, ErrNothingToMerge
+	}
+	return main, tip, commits, nil
+}
+
+// keepTopic checks the selected topic out again after pouring it failed
+// on the main branch, so my next messages go to the topic. The topic may
+// be gone, then the main chat stays selected
+func keepTopic(r *git.Repository, c *Chat) {
+	if c.Topic == "" {
+		return
+	}
+	if checkoutBranch(r, c.Topic) != nil {
+		c.Topic = ""
+	}
+}
+
+func mergeTopic(r *git.Repository, c *Chat, name string, auth transport.AuthMethod) error {
+	main, tip, commits, err := topicOnMain(r, c, name, auth)
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return err
+	}
+
+	err = applyTopicFiles(w, main, tip)
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		return err
+	}
+
+	author, err := commitAuthor()
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		return err
+	}
+
+	_, err = w.Commit(mergeMsg(name, commits), &git.CommitOptions{
+		Author:            author,
+		Signer:            commitSigner(),
+		Parents:           []plumbing.Hash{main.Hash, tip.Hash},
+		AllowEmptyCommits: true,
+	})
+	if err != nil {
+		appConfig.LogErr(err, "commiting merge of topic %s", name)
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		return err
+	}
+
+	err = push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(c.mainBranch)}})
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		if isPushRejected(err) {
+			return ErrPushRejected
+		}
+		return err
+	}
+
+	return removeTopicBranch(r, name, auth)
+}
+
+// removeTopicBranch deletes the topic from the remote and locally
+func removeTopicBranch(r *git.Repository, name string, auth transport.AuthMethod) error {
+	err := push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{deleteBranchRefSpec(name)}})
+	if err != nil {
+		return err
+	}
+
+	r.Storer.RemoveReference(plumbing.NewBranchReferenceName(name))
+	r.Storer.RemoveReference(remoteBranchRef(name))
+	return nil
+}
+
+// withRetries runs the operation again after a rejected push, as somebody
+// else may have pushed to the chat in between. The wait grows by the delay
+// with every retry
+func withRetries(delay time.Duration, op func() error) error {
+	var err error
+	for i := 0; i < pushRetries; i++ {
+		err = op()
+		if !errors.Is(err, ErrPushRejected) {
+			return err
+		}
+		appConfig.LogDebug("Push rejected, retry %d", i+1)
+		time.Sleep(time.Duration(i+1) * delay)
+	}
+	return err
+}
+
+// MergeTopic pours the topic into the main chat with a merge commit
+// carrying a summary of the discussion, then removes the topic.
+// The main chat is checked out afterwards, select it to reload messages
+func MergeTopic(name string) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	err := func() error {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+
+		if err := checkPermission(chat, PermWrite); err != nil {
+			return err
+		}
+
+		repo, err := openChatRepo(chat)
+		if err != nil {
+			return err
+		}
+
+		auth, err := getAuth(chat.username, chat.password)
+		if err != nil {
+			return err
+		}
+
+		err = withRetries(retryDelay, func() error {
+			return mergeTopic(repo, chat, name, auth)
+		})
+		if err != nil {
+			keepTopic(repo, chat)
+			return err
+		}
+
+		chat.Topic = ""
+		appConfig.LogDebug("Merge topic %s into %s", name, chat.Name)
+		return nil
+	}()
+	if err != nil {
+		return Chat{}, err
+	}
+
+	return *chat, nil
+}
+
+const digestMaxMsgs int = 100
+
+// TopicDigest returns the messages of the topic in the current chat
+// joined into a text, which is proposed as a digest before squashing
+func TopicDigest(name string) (string, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return "", ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := getAuth(chat.username, chat.password)
+	if err != nil {
+		return "", err
+	}
+
+	err = fetch(repo, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return "", err
+	}
+
+	main, err := getBranchCommit(repo, chat.mainBranch)
+	if err != nil {
+		return "", err
+	}
+
+	tip, err := getBranchCommit(repo, name)
+	if err != nil {
+		return "", ErrTopicNotFound
+	}
+
+	commits, err := getTopicCommits(tip, main)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for i := len(commits) - 1; i >= 0 && len(lines) < digestMaxMsgs; i-- {
+		m := msgFromCommit(commits[i])
+		lines = append(lines, fmt.Sprintf("%s: %s", m.Author, m.Text))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func digestMsg(name string, commits []*object.Commit, text string) string {
+	digest := fmt.Sprintf("Digest of topic %s\n\n%s", name, topicSummary(commits))
+	if text = strings.TrimSpace(text); text != "" {
+		digest += "\n\n" + text
+	}
+	return withTrailers(digest, trailer{trailerTopicSquashed, name})
+}
+
+func squashTopic(r *git.Repository, c *Chat, name, text string, auth transport.AuthMethod) error {
+	main, tip, commits, err := topicOnMain(r, c, name, auth)
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving worktree")
+		return err
+	}
+
+	err = applyTopicFiles(w, main, tip)
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		return err
+	}
+
+	// Files of the topic are staged already, so commit them all at once
+	err = commit(r, "", digestMsg(name, commits, text))
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		return err
+	}
+
+	err = push(r, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(c.mainBranch)}})
+	if err != nil {
+		w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: main.Hash})
+		if isPushRejected(err) {
+			return ErrPushRejected
+		}
+		return err
+	}
+
+	return removeTopicBranch(r, name, auth)
+}
+
+// SquashTopic replaces all messages of the topic with a single digest
+// message in the main chat and removes the topic. The text goes into the
+// digest after the summary of participants, message count and time span.
+// The main chat is checked out afterwards, select it to reload messages
+func SquashTopic(name, text string) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	err := func() error {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+
+		if err := checkPermission(chat, PermWrite); err != nil {
+			return err
+		}
+
+		repo, err := openChatRepo(chat)
+		if err != nil {
+			return err
+		}
+
+		auth, err := getAuth(chat.username, chat.password)
+		if err != nil {
+			return err
+		}
+
+		err = withRetries(retryDelay, func() error {
+			return squashTopic(repo, chat, name, text, auth)
+		})
+		if err != nil {
+			keepTopic(repo, chat)
+			return err
+		}
+
+		chat.Topic = ""
+		appConfig.LogDebug("Squash topic %s into %s", name, chat.Name)
+		return nil
+	}()
+	if err != nil {
+		return Chat{}, err
+	}
+
+	return *chat, nil
+}
+
+const archiveTagPrefix string = "archive/"
+
+func archiveTagRef(name string) plumbing.ReferenceName {
+	return plumbing.NewTagReferenceName(archiveTagPrefix + name)
+}
+
+func archiveRefSpec() config.RefSpec {
+	refs := plumbing.NewTagReferenceName(archiveTagPrefix + "*")
+	return config.RefSpec(fmt.Sprintf("+%s:%s", refs, refs))
+}
+
+func fetchArchive(r *git.Repository, auth transport.AuthMethod) error {
+	return fetch(r, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{archiveRefSpec()},
+		Auth:       auth,
+		Prune:      true,
+	})
+}
+
+// CloseTopic throws the topic out of the current chat without merging.
+// The topic stays recoverable under the refs/tags/archive/<topic> tag
+func CloseTopic(name string) (Chat, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Chat{}, ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	if err := checkPermission(chat, PermWrite); err != nil {
+		return Chat{}, err
+	}
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	auth, err := getAuth(chat.username, chat.password)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	err = fetch(repo, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return Chat{}, err
+	}
+
+	err = fetchArchive(repo, auth)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	tagRef := archiveTagRef(name)
+	if _, err := repo.Reference(tagRef, false); err == nil {
+		appConfig.LogErr(ErrArchiveExists, "topic %s", name)
+		return Chat{}, ErrArchiveExists
+	}
+
+	tipRef, err := repo.Reference(remoteBranchRef(name), true)
+	if err != nil {
+		appConfig.LogErr(err, "no remote topic %s", name)
+		return Chat{}, ErrTopicNotFound
+	}
+
+	err = checkoutBranch(repo, chat.mainBranch)
+	if err != nil {
+		return Chat{}, err
+	}
+	chat.Topic = ""
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference(tagRef, tipRef.Hash()))
+	if err != nil {
+		appConfig.LogErr(err, "creating archive tag for %s", name)
+		return Chat{}, err
+	}
+
+	err = push(repo, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("%s:%s", tagRef, tagRef)),
+	}})
+	if err != nil {
+		repo.Storer.RemoveReference(tagRef)
+		return Chat{}, err
+	}
+
+	err = removeTopicBranch(repo, name, auth)
+	if err != nil {
+		return Chat{}, err
+	}
+	appConfig.LogDebug("Close topic %s in %s", name, chat.Name)
+
+	return *chat, nil
+}
+
+func ListArchivedTopics(chat Chat) ([]Topic, error) {
+	c := findChatInList(chat)
+	if c == nil {
+		return nil, fmt.Errorf("chat %s not found", chat.Name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := openChatRepo(c)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := getAuth(c.username, c.password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetchArchive(repo, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	mainCommit, err := getBranchCommit(repo, c.mainBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := repo.Tags()
+	if err != nil {
+		appConfig.LogErr(err, "retrieving tags")
+		return nil, err
+	}
+
+	var topics []Topic
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if !strings.HasPrefix(name, archiveTagPrefix) {
+			return nil
+		}
+		name = strings.TrimPrefix(name, archiveTagPrefix)
+
+		tip, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			appConfig.LogErr(err, "retrieving commit of archived topic %s", name)
+			return err
+		}
+
+		commits, err := getTopicCommits(tip, mainCommit)
+		if err != nil {
+			return err
+		}
+
+		topics = append(topics, Topic{
+			Name:    name,
+			MsgNum:  len(commits),
+			LastMsg: msgFromCommit(tip),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].LastMsg.Time.After(topics[j].LastMsg.Time)
+	})
+	return topics, nil
+}
+
+// ReopenTopic brings the archived topic back to the current chat
+func ReopenTopic(name string) (Topic, error) {
+	chat := getCurrChat()
+	if chat == nil {
+		return Topic{}, ErrCurrChatNil
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	if err := checkPermission(chat, PermWrite); err != nil {
+		return Topic{}, err
+	}
+
+	repo, err := openChatRepo(chat)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	auth, err := getAuth(chat.username, chat.password)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	err = fetch(repo, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil {
+		return Topic{}, err
+	}
+
+	err = fetchArchive(repo, auth)
+	if err != nil {
+		return Topic{}, err
+	}
+
+	tagRef := archiveTagRef(name)
+	tag, err := repo.Reference(tagRef, true)
+	if err != nil {
+		appConfig.LogErr(err, "no archived topic %s", name)
+		return Topic{}, ErrTopicNotFound
+	}
+
+	if _, err := repo.Reference(remoteBranchRef(name), false); err == nil {
+		appConfig.LogErr(ErrTopicExists, "topic %s", name)
+		return Topic{}, ErrTopicExists
+	}
+
+	tip, err := repo.CommitObject(tag.Hash())
+	if err != nil {
+		appConfig.LogErr(err, "retrieving commit of archived topic %s", name)
+		return Topic{}, err
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(name)
+	err = repo.Storer.SetReference(plumbing.NewHashReference(branchRef, tip.Hash))
+	if err != nil {
+		appConfig.LogErr(err, "creating branch %s", name)
+		return Topic{}, err
+	}
+
+	err = push(repo, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{branchRefSpec(name)}})
+	if err != nil {
+		repo.Storer.RemoveReference(branchRef)
+		return Topic{}, err
+	}
+
+	err = push(repo, &git.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{
+		config.RefSpec(":" + tagRef.String()),
+	}})
+	if err != nil {
+		return Topic{}, err
+	}
+	repo.Storer.RemoveReference(tagRef)
+	appConfig.LogDebug("Reopen topic %s in %s", name, chat.Name)
+
+	return Topic{Name: name, LastMsg: msgFromCommit(tip)}, nil
+}
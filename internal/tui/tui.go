@@ -4,9 +4,15 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IlorDash/gitogram/internal/appConfig"
@@ -19,6 +25,7 @@ type chatInfo struct {
 	table      *tview.Table
 	msgNum     *tview.TableCell
 	membersNum *tview.TableCell
+	onlineNum  *tview.TableCell
 }
 
 type chatHeader struct {
@@ -31,7 +38,9 @@ type chatLayout struct {
 	panel    *tview.Flex
 	header   chatHeader
 	dialogue *tview.TextView
-	message  *tview.InputField
+	message  *tview.TextArea
+	replyTo  *client.Message
+	editing  *client.Message
 }
 
 func createChatHeader() chatHeader {
@@ -53,6 +62,11 @@ func createChatHeader() chatHeader {
 	h.info.membersNum = tview.NewTableCell("0")
 	h.info.table.SetCell(1, 1, h.info.membersNum)
 
+	h.info.table.SetCellSimple(2, 0, "Online:")
+	h.info.table.GetCell(2, 0).SetAlign(tview.AlignRight)
+	h.info.onlineNum = tview.NewTableCell("0")
+	h.info.table.SetCell(2, 1, h.info.onlineNum)
+
 	h.panel = tview.NewFlex().SetDirection(tview.FlexColumn)
 	h.panel.SetBorder(true)
 	h.panel.AddItem(h.name, 0, 1, false)
@@ -92,11 +106,60 @@ func (s *appScreen) membersNum(num int) {
 	})
 }
 
+func (s *appScreen) onlineNum(online, idle int) {
+	queueUpdateAndDraw(s.app, func() {
+		h := s.main.chat.header
+		if h.info.onlineNum == nil {
+			return
+		}
+		text := strconv.Itoa(online)
+		if idle > 0 {
+			text += fmt.Sprintf(" (%d idle)", idle)
+		}
+		h.info.onlineNum.SetText(text)
+	})
+}
+
+const (
+	composerPlaceholder string = "Write a message... Alt+Enter for a new line, Ctrl+O for $EDITOR"
+	readOnlyPlaceholder string = "You can only read this chat"
+)
+
+// commands shows the commands my role in the chat allows
+func (s *appScreen) commands() {
+	queueUpdateAndDraw(s.app, func() {
+		if s.main.cmds != nil {
+			fillCommands(s.main.cmds)
+		}
+	})
+}
+
+// composer tells, if my role in the chat does not allow to write to it
+func (s *appScreen) composer(c client.Chat) {
+	queueUpdateAndDraw(s.app, func() {
+		placeholder := composerPlaceholder
+		if !client.Allowed(c, client.PermWrite) {
+			placeholder = readOnlyPlaceholder
+		}
+		s.main.chat.message.SetPlaceholder(placeholder)
+	})
+}
+
+func chatHeaderName(c client.Chat) string {
+	if c.Topic == "" {
+		return c.Name
+	}
+	return fmt.Sprintf("%s #%s", c.Name, c.Topic)
+}
+
 func updateChatHeader(s *appScreen, c client.Chat) {
 	go func() {
-		s.chatName(c.Name)
+		s.chatName(chatHeaderName(c))
 		s.membersNum(c.MembersNum)
 		s.msgNum(c.MsgNum)
+		s.onlineNum(client.OnlineNum(c))
+		s.commands()
+		s.composer(c)
 	}()
 }
 
@@ -111,32 +174,86 @@ func createChatLayout(s *appScreen, p *tview.Pages) *chatLayout {
 	c.dialogue.SetChangedFunc(func() {
 		s.app.Draw()
 	})
-	c.dialogue.SetDynamicColors(true).SetBorder(true)
-
-	var msg string
-	c.message = tview.NewInputField().
-		SetPlaceholder("Write a message...").
-		SetFieldTextColor(tcell.ColorSilver).
-		SetPlaceholderTextColor(tcell.ColorGray).
-		SetChangedFunc(func(newMsg string) {
-			msg = newMsg
-		}).
-		SetDoneFunc(func(key tcell.Key) {
-			chat, err := client.SendMsg(msg)
-			if err != nil {
-				closeModalForm(p)
-				addInfoModal(p, "Unexpected error during send message",
-					"Encountered unexpected error during send message. Please look into the logs.")
-				return
+	c.dialogue.SetDynamicColors(true).SetRegions(true).SetBorder(true)
+	c.dialogue.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			selectMsg(s, -1)
+			return nil
+		case tcell.KeyDown:
+			selectMsg(s, 1)
+			return nil
+		case tcell.KeyPgUp, tcell.KeyHome:
+			if row, _ := c.dialogue.GetScrollOffset(); row == 0 {
+				dlg.mu.Lock()
+				loadOlderMsgs(s)
+				dlg.mu.Unlock()
 			}
-			c.message.SetText("")
-			updateChatHeader(s, chat)
-			updChatInList(s, s.main.selectChatIndex, chat)
-		})
+			return event
+		case tcell.KeyEnter:
+			toggleMsg(s)
+			return nil
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case 'r':
+				if permitted(client.PermWrite) {
+					startReply(s)
+				}
+				return nil
+			case 'e':
+				if permitted(client.PermWrite) {
+					startEdit(s)
+				}
+				return nil
+			case 'i':
+				showMsgDetails(s, p)
+				return nil
+			case 'd':
+				addRetractModal(s, p)
+				return nil
+			case '+':
+				if permitted(client.PermWrite) {
+					addReactModal(s, p)
+				}
+				return nil
+			case 's':
+				addSaveAttachmentModal(s, p)
+				return nil
+			}
+		}
+		return event
+	})
+
+	c.message = tview.NewTextArea().
+		SetPlaceholder(composerPlaceholder).
+		SetTextStyle(composerStyle(tcell.ColorSilver)).
+		SetPlaceholderStyle(composerStyle(tcell.ColorGray))
+	c.message.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if !permitted(client.PermWrite) {
+			return nil
+		}
+
+		switch event.Key() {
+		case tcell.KeyEscape:
+			resetComposer(s)
+			return nil
+		case tcell.KeyEnter:
+			// Let the text area put a new line
+			if event.Modifiers()&(tcell.ModAlt|tcell.ModShift) != 0 {
+				return event
+			}
+			sendComposed(s, p, c.message.GetText())
+			return nil
+		case tcell.KeyCtrlO:
+			composeInEditor(s, p)
+			return nil
+		}
+		return event
+	})
 
 	c.panel.AddItem(c.header.panel, 0, 2, false).
 		AddItem(c.dialogue, 0, 8, false).
-		AddItem(c.message, 0, 1, false)
+		AddItem(c.message, 0, 2, false)
 
 	return c
 }
@@ -152,6 +269,19 @@ func chatListBottomStr(a string, m string, n int) string {
 	}
 }
 
+const deletedMsgText string = "message deleted"
+
+// previewText returns the text of the last message for the chat list
+func previewText(m client.Message) string {
+	if m.Deleted || m.Retracts != "" {
+		return deletedMsgText
+	}
+	if m.Text == "" && m.Attachment != "" {
+		return "📎 " + client.AttachmentName(m)
+	}
+	return strings.SplitN(m.Text, "\n", 2)[0]
+}
+
 func chatListRelativeTime(t time.Time) string {
 	if time.Since(t) < 24*time.Hour {
 		return t.Format("15:04")
@@ -162,31 +292,129 @@ func chatListRelativeTime(t time.Time) string {
 	}
 }
 
-func handleChatSelected(s *appScreen, chat client.Chat) {
+func clearDialogue(s *appScreen) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	dlg.msgs = nil
+	dlg.expanded = make(map[string]bool)
+	dlg.parents = make(map[string]client.Message)
+	dlg.selected = -1
+	dlg.hasOlder = false
+	dlg.firstUnread = ""
+	s.main.chat.dialogue.Clear()
+	prevDate = time.Time{}
+}
+
+// selectChat opens the chat in the dialogue with its latest messages
+func selectChat(s *appScreen, chat client.Chat) (client.Chat, error) {
+	clearDialogue(s)
+	chat, err := client.SelectChat(chat)
+	if err != nil {
+		return client.Chat{}, err
+	}
+	loadLatestMsgs(s, chat)
+	return chat, nil
+}
+
+func handleChatSelected(s *appScreen, p *tview.Pages, chat client.Chat) {
 	log.Printf("Selected %s chat\n", chat.Name)
-	selectedChat, err := client.SelectChat(chat)
+	selectedChat, err := selectChat(s, chat)
 	if err != nil {
 		return
 	}
 	updateChatHeader(s, selectedChat)
-	s.main.selectChatIndex = s.main.chatList.GetCurrentItem()
-	updChatInList(s, s.main.selectChatIndex, selectedChat)
+	collapseTopics(s)
+	s.main.selectChatIndex = getChatListChatIndex(s, selectedChat)
+	updChatInList(s, p, s.main.selectChatIndex, selectedChat)
+	expandTopics(s, p, selectedChat)
 }
 
-func addNewChatToList(s *appScreen, list *tview.List, chat client.Chat) {
+func addNewChatToList(s *appScreen, p *tview.Pages, list *tview.List, chat client.Chat) {
 	list.AddItem(chatListUpperStr(chat.Name, chatListRelativeTime(chat.LastMsg.Time)),
-		chatListBottomStr(chat.LastMsg.Author, chat.LastMsg.Text, chat.NonReadMsgNum), 0,
-		func() { handleChatSelected(s, chat) })
+		chatListBottomStr(client.VisibleName(chat, chat.LastMsg.Author), previewText(chat.LastMsg), chat.NonReadMsgNum), 0,
+		func() { handleChatSelected(s, p, chat) })
 }
 
-func updChatInList(s *appScreen, index int, chat client.Chat) {
+func updChatInList(s *appScreen, p *tview.Pages, index int, chat client.Chat) {
 	s.main.chatList.RemoveItem(index)
 
 	s.main.chatList.InsertItem(index,
 		chatListUpperStr(chat.Name, chatListRelativeTime(chat.LastMsg.Time)),
-		chatListBottomStr(chat.LastMsg.Author, chat.LastMsg.Text, chat.NonReadMsgNum),
+		chatListBottomStr(client.VisibleName(chat, chat.LastMsg.Author), previewText(chat.LastMsg), chat.NonReadMsgNum),
 		0,
-		func() { handleChatSelected(s, chat) })
+		func() { handleChatSelected(s, p, chat) })
+	s.main.chatList.SetCurrentItem(s.main.selectChatIndex)
+}
+
+const mainTopicName string = "main"
+
+func topicListUpperStr(n string, t string) string {
+	return fmt.Sprintf("  # %s %s", n, t)
+}
+
+func topicListBottomStr(a string, m string, n int) string {
+	return "    " + chatListBottomStr(a, m, n)
+}
+
+func handleTopicSelected(s *appScreen, p *tview.Pages, topic string) {
+	log.Printf("Selected %s topic\n", topic)
+	clearDialogue(s)
+	chat, err := client.SwitchTopic(topic)
+	if err != nil {
+		addInfoModal(p, "Cannot switch topic",
+			"Encountered unexpected error during switch topic. Please look into the logs.")
+		return
+	}
+	loadLatestMsgs(s, chat)
+	updateChatHeader(s, chat)
+	updChatInList(s, p, s.main.selectChatIndex, chat)
+}
+
+// collapseTopics removes topic items shown under the selected chat
+func collapseTopics(s *appScreen) {
+	for ; s.main.topicItems > 0; s.main.topicItems-- {
+		s.main.chatList.RemoveItem(s.main.selectChatIndex + 1)
+	}
+}
+
+// expandTopics shows the topic selector under the selected chat
+func expandTopics(s *appScreen, p *tview.Pages, chat client.Chat) {
+	collapseTopics(s)
+
+	topics, err := client.ListTopics(chat)
+	if err != nil {
+		return
+	}
+	showTopics(s, p, chat, topics)
+}
+
+// showTopics puts the listed topics under the selected chat,
+// the topics shown before must be collapsed
+func showTopics(s *appScreen, p *tview.Pages, chat client.Chat, topics []client.Topic) {
+	index := s.main.selectChatIndex + 1
+	insertTopic := func(upper, bottom string, selected func()) {
+		s.main.chatList.InsertItem(index, upper, bottom, 0, selected)
+		index++
+		s.main.topicItems++
+	}
+
+	insertTopic(topicListUpperStr(mainTopicName, ""), "", func() {
+		handleTopicSelected(s, p, "")
+	})
+	for _, t := range topics {
+		topic := t
+		insertTopic(topicListUpperStr(topic.Name, chatListRelativeTime(topic.LastMsg.Time)),
+			topicListBottomStr(client.VisibleName(chat, topic.LastMsg.Author), previewText(topic.LastMsg), topic.MsgNum),
+			func() { handleTopicSelected(s, p, topic.Name) })
+	}
+	insertTopic("  + New topic", "", addTopicModal(s, p))
+	insertTopic("  ~ Archived topics", "", func() {
+		go func() {
+			addArchivedTopicsModal(s, p, chat)
+		}()
+	})
+
 	s.main.chatList.SetCurrentItem(s.main.selectChatIndex)
 }
 
@@ -202,7 +430,7 @@ func createChatList(s *appScreen, p *tview.Pages) (*tview.List, error) {
 
 	for i := 0; i < len(chats); i++ {
 		index := i
-		addNewChatToList(s, chatList, chats[index])
+		addNewChatToList(s, p, chatList, chats[index])
 	}
 
 	return chatList, nil
@@ -221,11 +449,20 @@ func getChatListChatIndex(s *appScreen, chat client.Chat) int {
 
 var updChatChann chan client.Chat
 
-func waitChatForUpd(s *appScreen) {
+func waitChatForUpd(s *appScreen, p *tview.Pages) {
 	go func() {
 		for {
 			updChat := <-updChatChann
-			updChatInList(s, getChatListChatIndex(s, updChat), updChat)
+			updChatInList(s, p, getChatListChatIndex(s, updChat), updChat)
+			if curr, err := client.GetCurrChat(); err == nil && curr.Name == updChat.Name {
+				updateChatHeader(s, updChat)
+				updateVisibleNames(s, updChat)
+				if s.currPage == "members" {
+					s.app.QueueUpdateDraw(func() {
+						fillMembers(s, p)
+					})
+				}
+			}
 		}
 	}()
 }
@@ -283,75 +520,274 @@ func createLog(s *appScreen, p *tview.Pages) *logLayout {
 	return log
 }
 
-const msgFocusNum int = 2
+type searchLayout struct {
+	panel   *tview.Flex
+	query   *tview.InputField
+	results *tview.List
+	button  *tview.Button
+	focus   *focusStruct
+	hits    []client.SearchHit
+}
 
-type mainLayout struct {
-	panel           *tview.Flex
-	chatList        *tview.List
-	selectChatIndex int
-	chat            *chatLayout
-	cmds            *tview.Flex
-	focus           *focusStruct
+func searchResultUpperStr(hit client.SearchHit) string {
+	place := hit.Chat.Name
+	if hit.Topic != "" {
+		place += " #" + hit.Topic
+	}
+	return fmt.Sprintf("%s %s %s", place, client.VisibleName(hit.Chat, hit.Msg.Author), hit.Msg.Time.Format("02.01.2006 15:04"))
 }
 
-func createMain(s *appScreen, p *tview.Pages) (*mainLayout, error) {
-	var err error
-	main := &mainLayout{}
+func handleSearch(s *appScreen, p *tview.Pages, query string) {
+	hits, err := client.Search(query)
+
+	s.app.QueueUpdateDraw(func() {
+		s.search.results.Clear()
+		s.search.hits = hits
+		switch {
+		case errors.Is(err, client.ErrInvalidQuery):
+			s.search.results.AddItem("Invalid query", err.Error(), 0, nil)
+			return
+		case err != nil:
+			s.search.results.AddItem("Search failed", "Please look into the logs.", 0, nil)
+			return
+		case len(hits) == 0:
+			s.search.results.AddItem("Nothing found", "", 0, nil)
+			return
+		}
 
-	main.chatList, err = createChatList(s, p)
+		for _, h := range hits {
+			hit := h
+			s.search.results.AddItem(tview.Escape(searchResultUpperStr(hit)), "  "+tview.Escape(hit.Context), 0, func() {
+				go func() {
+					jumpToMsg(s, p, hit)
+				}()
+			})
+		}
+	})
+}
+
+// jumpToMsg opens the chat, and the topic if needed, of the search hit
+// and selects the found message, loading older messages up to it.
+// Chat is pulled here, only the widgets are updated in the UI goroutine
+func jumpToMsg(s *appScreen, p *tview.Pages, hit client.SearchHit) {
+	log.Printf("Jump to %s in %s chat\n", hit.Msg.Hash, hit.Chat.Name)
+	clearDialogue(s)
+	chat, err := client.SelectChat(hit.Chat)
 	if err != nil {
-		return nil, err
+		return
 	}
-	main.selectChatIndex = 0
-	main.chat = createChatLayout(s, p)
-	main.cmds = createCommands(s, p)
+	if hit.Topic != "" {
+		chat, err = client.SwitchTopic(hit.Topic)
+		if err != nil {
+			s.app.QueueUpdateDraw(func() {
+				addInfoModal(p, "Cannot switch topic",
+					"Encountered unexpected error during switch topic. Please look into the logs.")
+			})
+			return
+		}
+	}
+	topics, topicsErr := client.ListTopics(chat)
 
-	innerLayout := tview.NewFlex().SetDirection(tview.FlexColumn).
-		AddItem(main.chatList, 0, 1, true).
-		AddItem(main.chat.panel, 0, 3, false)
+	loadLatestMsgs(s, chat)
+	dlg.mu.Lock()
+	for !selectMsgByHash(s, hit.Msg.Hash) {
+		if !loadOlderMsgs(s) {
+			break
+		}
+	}
+	dlg.mu.Unlock()
 
-	main.panel = tview.NewFlex().SetDirection(tview.FlexRow).
-		AddItem(innerLayout, 0, 20, true).AddItem(main.cmds, 3, 1, false)
+	s.app.QueueUpdateDraw(func() {
+		p.SwitchToPage("main")
+		s.currPage, _ = p.GetFrontPage()
 
-	main.panel.SetBorder(true).SetTitle("Gitogram v0.1")
+		updateChatHeader(s, chat)
+		collapseTopics(s)
+		s.main.selectChatIndex = getChatListChatIndex(s, chat)
+		updChatInList(s, p, s.main.selectChatIndex, chat)
+		if topicsErr == nil {
+			showTopics(s, p, chat, topics)
+		}
 
-	main.highlightPanel(main.chatList)
+		if panel, err := s.main.focus.setPanel(dialogueFocusNum); err == nil {
+			s.app.SetFocus(panel)
+			s.main.highlightPanel(panel)
+		}
+	})
+}
 
-	waitChatForUpd(s)
+func createSearch(s *appScreen, p *tview.Pages) *searchLayout {
+	search := &searchLayout{}
 
-	return main, nil
+	search.query = tview.NewInputField().
+		SetLabel("Search: ").
+		SetPlaceholder("words or regexp, author:name chat:name after:2006-01-02 before:02.01.2006").
+		SetPlaceholderTextColor(tcell.ColorGray)
+	search.query.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		query := search.query.GetText()
+		go func() {
+			handleSearch(s, p, query)
+		}()
+	})
+	search.query.SetBorder(true)
+
+	search.results = tview.NewList()
+	search.results.SetBorder(true).SetTitle("Messages")
+
+	search.button = tview.NewButton("Return").SetSelectedFunc(func() {
+		p.SwitchToPage("main")
+		s.currPage, _ = p.GetFrontPage()
+	})
+	search.button.SetBackgroundColorActivated(tcell.ColorGreen)
+	search.button.SetLabelColorActivated(tcell.ColorWhite)
+
+	buttonRow := tview.NewFlex().SetDirection(tview.FlexColumn).
+		AddItem(tview.NewBox(), 0, 6, false).
+		AddItem(search.button, 0, 2, false).
+		AddItem(tview.NewBox(), 0, 6, false)
+
+	search.panel = tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(search.query, 3, 1, true).
+		AddItem(search.results, 0, 10, false).
+		AddItem(buttonRow, 0, 1, false)
+	search.panel.SetBorder(true).SetTitle("Search")
+
+	return search
 }
 
-type appScreen struct {
-	app      *tview.Application
-	main     *mainLayout
-	log      *logLayout
-	currPage string
+type membersLayout struct {
+	panel  *tview.Flex
+	list   *tview.List
+	button *tview.Button
+	focus  *focusStruct
 }
 
-func createModalForm(form tview.Primitive, height int, width int) tview.Primitive {
-	modal := tview.NewFlex().SetDirection(tview.FlexColumn).
-		AddItem(nil, 0, 1, false).
-		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-			AddItem(nil, 0, 1, false).
-			AddItem(form, height, 10, true).
-			AddItem(nil, 0, 1, false), width, 1, true).
-		AddItem(nil, 0, 1, false)
-	return modal
+var presenceColors = map[client.PresenceState]string{
+	client.PresenceOnline:  "green",
+	client.PresenceIdle:    "yellow",
+	client.PresenceOffline: "gray",
 }
 
-func closeModalForm(p *tview.Pages) {
-	p.SwitchToPage("main")
+func memberUpperStr(visibleName, username string, state client.PresenceState) string {
+	name := visibleName
+	if name != username {
+		name = fmt.Sprintf("%s (%s)", visibleName, username)
+	}
+	return fmt.Sprintf("[%s]●[-] %s", presenceColors[state], tview.Escape(name))
+}
+
+func memberBottomStr(role client.Role, state client.PresenceState, activity time.Time) string {
+	if activity.IsZero() {
+		return fmt.Sprintf("  %s, %s", role, state)
+	}
+	return fmt.Sprintf("  %s, %s, last active %s", role, state, activity.Format("02.01.2006 15:04"))
+}
+
+// fillMembers lists the members of the current chat, the online first
+func fillMembers(s *appScreen, p *tview.Pages) {
+	curr := s.members.list.GetCurrentItem()
+	s.members.list.Clear()
+
+	chat, err := client.GetCurrChat()
+	if err != nil {
+		return
+	}
+	s.members.panel.SetTitle("Members of " + chat.Name)
+
+	members := slices.Clone(chat.Members)
+	sort.SliceStable(members, func(i, j int) bool {
+		return chat.Presence[members[i].Username].State > chat.Presence[members[j].Username].State
+	})
+
+	for _, m := range members {
+		username := m.Username
+		presence, ok := chat.Presence[username]
+		activity := m.Activity
+		if ok {
+			activity = presence.Activity
+		}
+
+		s.members.list.AddItem(memberUpperStr(m.VisibleName, username, presence.State),
+			memberBottomStr(client.MemberRole(chat, username), presence.State, activity), 0, func() {
+				addMemberModal(s, p, chat, username)
+			})
+	}
+	s.members.list.SetCurrentItem(curr)
+}
+
+func addMemberModal(s *appScreen, p *tview.Pages, chat client.Chat, username string) {
+	memberForm := tview.NewForm()
+	memberForm.AddTextView("",
+		fmt.Sprintf("What to do with %s?", username),
+		0, 0, false, false)
+
+	if me, err := client.GetUserName(); err == nil && me != username {
+		memberForm.AddButton("Topic for two", func() {
+			addDirectChatModal(s, p, username)
+		})
+	}
+	memberForm.AddButton("Copy email", func() {
+		go func() {
+			handleCopyEmail(s, p, username)
+		}()
+	})
+	if me, err := client.GetUserName(); err == nil && me == username && client.CanPublishSigningKey(chat) {
+		memberForm.AddButton("Publish signing key", func() {
+			go func() {
+				handlePublishSigningKey(s, p)
+			}()
+		})
+	}
+
+	width := 70
+	if client.CanManage(chat, username) {
+		for _, role := range client.GivableRoles(chat) {
+			if role == client.MemberRole(chat, username) {
+				continue
+			}
+			memberForm.AddButton("Make "+string(role), func() {
+				go func() {
+					handleSetMemberRole(s, p, username, role)
+				}()
+			})
+		}
+		memberForm.AddButton("Kick", func() {
+			go func() {
+				handleKickMember(s, p, username)
+			}()
+		})
+		width = 110
+	}
+
+	memberForm.AddButton("Cancel", func() {
+		closeMembersModal(s, p)
+	})
+
+	memberForm.SetButtonsAlign(tview.AlignCenter)
+	memberForm.SetBorder(true).SetTitle("Member " + username)
+	modal := createModalForm(memberForm, 7, width)
+	p.AddPage("modal", modal, true, true)
+}
+
+// closeMembersModal returns to the members page, unlike closeModalForm
+func closeMembersModal(s *appScreen, p *tview.Pages) {
 	p.RemovePage("modal")
+	p.SwitchToPage("members")
+	s.app.SetFocus(s.members.list)
 }
 
-func addInfoModal(p *tview.Pages, title string, info string) {
+// addMembersInfoModal is addInfoModal over the members page
+func addMembersInfoModal(s *appScreen, p *tview.Pages, title string, info string) {
 	addInfoForm := tview.NewForm()
 	addInfoForm.AddTextView("",
 		info,
 		0, 0, false, false)
 	addInfoForm.AddButton("Close", func() {
-		closeModalForm(p)
+		closeMembersModal(s, p)
 	})
 
 	addInfoForm.SetButtonsAlign(tview.AlignCenter)
@@ -360,45 +796,292 @@ func addInfoModal(p *tview.Pages, title string, info string) {
 	p.AddPage("modal", modal, true, true)
 }
 
-func handleAddChat(s *appScreen, p *tview.Pages, chatUrl, username, password string) {
-	chat, err := client.AddChat(chatUrl, username, password)
+// addDirectChatModal warns that the topic named after both members
+// is not private before opening it
+func addDirectChatModal(s *appScreen, p *tview.Pages, username string) {
+	me, _ := client.GetUserName()
+	topic := client.DirectTopicName(me, username)
 
-	switch {
-	case errors.Is(err, client.ErrKnownhosts):
-		closeModalForm(p)
-		addHostModal(s, p, chatUrl)
-	case errors.Is(err, client.ErrChatAlreadyAdded):
-		closeModalForm(p)
-		addInfoModal(p, "Chat is already added", "Chat is already added. "+
-			"Nothind to do.")
-	case errors.Is(err, client.ErrCommitChatInfo):
-		closeModalForm(p)
-		addInfoModal(p, "Cannot create chat info",
-			"Failed to commit new chat info file, so removed chat info file. "+
-				"Please check your authorization and try add chat again.")
-	case errors.Is(err, client.ErrPushChatInfo):
-		closeModalForm(p)
-		if errors.Is(err, client.ErrResetLastCommit) {
-			addInfoModal(p, "Cannot create chat info",
-				"Failed to push new chat info file and reset it, so removed chat entirely. "+
-					"Please check your authorization and try add chat again.")
-		} else {
-			addInfoModal(p, "Cannot create chat info",
-				"Failed to push new chat info file, so reset this last commit. "+
-					"Please check your authorization and try add chat again.")
-		}
-	case errors.Is(err, client.ErrAuthenticationRequired):
-		closeModalForm(p)
-		addAuthModal(s, p, chatUrl)
-	case err != nil:
-		closeModalForm(p)
-		addInfoModal(p, "Unexpected error during add chat",
-			"Encountered unexpected error during add chat. Please look into the logs.")
-	default:
-		closeModalForm(p)
-		s.app.QueueUpdateDraw(func() {
-			addNewChatToList(s, s.main.chatList, chat)
-		})
+	directForm := tview.NewForm()
+	directForm.AddTextView("",
+		fmt.Sprintf("%s is a public topic named after you and %s. Every member of the chat can read and write to it.", topic, username),
+		0, 0, false, false)
+	directForm.AddButton("Open", func() {
+		go func() {
+			handleDirectChat(s, p, username)
+		}()
+	})
+	directForm.AddButton("Cancel", func() {
+		closeMembersModal(s, p)
+	})
+
+	directForm.SetButtonsAlign(tview.AlignCenter)
+	directForm.SetBorder(true).SetTitle("Topic for two")
+	modal := createModalForm(directForm, 9, 70)
+	p.RemovePage("modal")
+	p.AddPage("modal", modal, true, true)
+}
+
+// handleDirectChat opens the public topic of the current chat
+// named after me and the member
+func handleDirectChat(s *appScreen, p *tview.Pages, username string) {
+	topic, err := client.DirectTopic(username)
+	if err != nil {
+		s.app.QueueUpdateDraw(func() {
+			closeMembersModal(s, p)
+			addMembersInfoModal(s, p, "Cannot open topic",
+				"Encountered unexpected error during open topic for two. Please look into the logs.")
+		})
+		return
+	}
+
+	s.app.QueueUpdateDraw(func() {
+		p.RemovePage("modal")
+		p.SwitchToPage("main")
+		s.currPage, _ = p.GetFrontPage()
+
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			return
+		}
+		expandTopics(s, p, chat)
+		handleTopicSelected(s, p, topic)
+
+		if panel, err := s.main.focus.setPanel(msgFocusNum); err == nil {
+			s.app.SetFocus(panel)
+			s.main.highlightPanel(panel)
+		}
+	})
+}
+
+var clipboardCmds = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"clip.exe"},
+}
+
+// copyToClipboard pipes the text to the first clipboard tool found
+func copyToClipboard(text string) error {
+	for _, args := range clipboardCmds {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return exec.ErrNotFound
+}
+
+func handleCopyEmail(s *appScreen, p *tview.Pages, username string) {
+	email, err := client.MemberEmail(username)
+
+	s.app.QueueUpdateDraw(func() {
+		closeMembersModal(s, p)
+		switch {
+		case errors.Is(err, client.ErrMemberNotFound):
+			addMembersInfoModal(s, p, "No email", fmt.Sprintf("%s has not written to the chat yet.", username))
+		case err != nil:
+			addMembersInfoModal(s, p, "Cannot find email",
+				"Encountered unexpected error during find email. Please look into the logs.")
+		default:
+			if err := copyToClipboard(email); err != nil {
+				appConfig.LogErr(err, "copying email of %s", username)
+				addMembersInfoModal(s, p, "Email of "+username,
+					fmt.Sprintf("No clipboard tool found, copy it by hand: %s", email))
+				return
+			}
+			addMembersInfoModal(s, p, "Email copied", fmt.Sprintf("%s is in the clipboard.", email))
+		}
+	})
+}
+
+// showMemberChange shows the members of the chat after a role change or kick
+func showMemberChange(s *appScreen, p *tview.Pages, chat client.Chat, err error, action string) {
+	s.app.QueueUpdateDraw(func() {
+		closeMembersModal(s, p)
+		switch {
+		case errors.Is(err, client.ErrNotPermitted):
+			addMembersInfoModal(s, p, "Not permitted",
+				fmt.Sprintf("Your role does not allow to %s the member.", action))
+		case errors.Is(err, client.ErrTopicSelected):
+			addMembersInfoModal(s, p, "Topic selected",
+				"Members are kept in the main chat. Choose # main under the chat and try again.")
+		case err != nil:
+			addMembersInfoModal(s, p, fmt.Sprintf("Cannot %s member", action),
+				fmt.Sprintf("Encountered unexpected error during %s member. Please look into the logs.", action))
+		default:
+			fillMembers(s, p)
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+			updateChatHeader(s, chat)
+		}
+	})
+}
+
+func handleSetMemberRole(s *appScreen, p *tview.Pages, username string, role client.Role) {
+	chat, err := client.SetMemberRole(username, role)
+	showMemberChange(s, p, chat, err, "change role of")
+}
+
+func handleKickMember(s *appScreen, p *tview.Pages, username string) {
+	chat, err := client.KickMember(username)
+	showMemberChange(s, p, chat, err, "kick")
+}
+
+func handlePublishSigningKey(s *appScreen, p *tview.Pages) {
+	chat, err := client.PublishSigningKey()
+	showMemberChange(s, p, chat, err, "publish signing key of")
+}
+
+func createMembers(s *appScreen, p *tview.Pages) *membersLayout {
+	members := &membersLayout{}
+
+	members.list = tview.NewList()
+	members.list.SetBorder(true)
+
+	members.button = tview.NewButton("Return").SetSelectedFunc(func() {
+		p.SwitchToPage("main")
+		s.currPage, _ = p.GetFrontPage()
+	})
+	members.button.SetBackgroundColorActivated(tcell.ColorGreen)
+	members.button.SetLabelColorActivated(tcell.ColorWhite)
+
+	buttonRow := tview.NewFlex().SetDirection(tview.FlexColumn).
+		AddItem(tview.NewBox(), 0, 6, false).
+		AddItem(members.button, 0, 2, false).
+		AddItem(tview.NewBox(), 0, 6, false)
+
+	members.panel = tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(members.list, 0, 10, true).
+		AddItem(buttonRow, 0, 1, false)
+	members.panel.SetBorder(true).SetTitle("Members")
+
+	return members
+}
+
+const dialogueFocusNum int = 1
+const msgFocusNum int = 2
+
+type mainLayout struct {
+	panel           *tview.Flex
+	chatList        *tview.List
+	selectChatIndex int
+	topicItems      int
+	chat            *chatLayout
+	cmds            *tview.Flex
+	focus           *focusStruct
+}
+
+func createMain(s *appScreen, p *tview.Pages) (*mainLayout, error) {
+	var err error
+	main := &mainLayout{}
+
+	main.chatList, err = createChatList(s, p)
+	if err != nil {
+		return nil, err
+	}
+	main.selectChatIndex = 0
+	main.chat = createChatLayout(s, p)
+	main.cmds = createCommands(s, p)
+
+	innerLayout := tview.NewFlex().SetDirection(tview.FlexColumn).
+		AddItem(main.chatList, 0, 1, true).
+		AddItem(main.chat.panel, 0, 3, false)
+
+	main.panel = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(innerLayout, 0, 20, true).AddItem(main.cmds, 3, 1, false)
+
+	main.panel.SetBorder(true).SetTitle("Gitogram v0.1")
+
+	main.highlightPanel(main.chatList)
+
+	waitChatForUpd(s, p)
+
+	return main, nil
+}
+
+type appScreen struct {
+	app      *tview.Application
+	main     *mainLayout
+	log      *logLayout
+	search   *searchLayout
+	members  *membersLayout
+	currPage string
+}
+
+func createModalForm(form tview.Primitive, height int, width int) tview.Primitive {
+	modal := tview.NewFlex().SetDirection(tview.FlexColumn).
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(form, height, 10, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+	return modal
+}
+
+func closeModalForm(p *tview.Pages) {
+	p.SwitchToPage("main")
+	p.RemovePage("modal")
+}
+
+func addInfoModal(p *tview.Pages, title string, info string) {
+	addInfoForm := tview.NewForm()
+	addInfoForm.AddTextView("",
+		info,
+		0, 0, false, false)
+	addInfoForm.AddButton("Close", func() {
+		closeModalForm(p)
+	})
+
+	addInfoForm.SetButtonsAlign(tview.AlignCenter)
+	addInfoForm.SetBorder(true).SetTitle(title)
+	modal := createModalForm(addInfoForm, 12, 70)
+	p.AddPage("modal", modal, true, true)
+}
+
+func handleAddChat(s *appScreen, p *tview.Pages, chatUrl, username, password string) {
+	chat, err := client.AddChat(chatUrl, username, password)
+
+	switch {
+	case errors.Is(err, client.ErrKnownhosts):
+		closeModalForm(p)
+		addHostModal(s, p, chatUrl)
+	case errors.Is(err, client.ErrChatAlreadyAdded):
+		closeModalForm(p)
+		addInfoModal(p, "Chat is already added", "Chat is already added. "+
+			"Nothind to do.")
+	case errors.Is(err, client.ErrCommitChatInfo):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot create chat info",
+			"Failed to commit new chat info file, so removed chat info file. "+
+				"Please check your authorization and try add chat again.")
+	case errors.Is(err, client.ErrPushChatInfo):
+		closeModalForm(p)
+		if errors.Is(err, client.ErrResetLastCommit) {
+			addInfoModal(p, "Cannot create chat info",
+				"Failed to push new chat info file and reset it, so removed chat entirely. "+
+					"Please check your authorization and try add chat again.")
+		} else {
+			addInfoModal(p, "Cannot create chat info",
+				"Failed to push new chat info file, so reset this last commit. "+
+					"Please check your authorization and try add chat again.")
+		}
+	case errors.Is(err, client.ErrAuthenticationRequired):
+		closeModalForm(p)
+		addAuthModal(s, p, chatUrl)
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during add chat",
+			"Encountered unexpected error during add chat. Please look into the logs.")
+	default:
+		closeModalForm(p)
+		s.app.QueueUpdateDraw(func() {
+			addNewChatToList(s, p, s.main.chatList, chat)
+		})
 	}
 }
 
@@ -463,266 +1146,1647 @@ func addHostModal(s *appScreen, p *tview.Pages, chatUrl string) {
 	p.AddPage("modal", modal, true, true)
 }
 
-func addChatModal(s *appScreen, p *tview.Pages) func() {
+func handleAddTopic(s *appScreen, p *tview.Pages, name string) {
+	_, err := client.CreateTopic(name)
+
+	switch {
+	case errors.Is(err, client.ErrInvalidTopicName):
+		closeModalForm(p)
+		addInfoModal(p, "Invalid topic name",
+			"Topic name may contain only letters, digits, '.', '_' and '-'.")
+	case errors.Is(err, client.ErrTopicExists):
+		closeModalForm(p)
+		addInfoModal(p, "Topic already exists", "Topic is already created. "+
+			"Nothing to do.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during add topic",
+			"Encountered unexpected error during add topic. Please look into the logs.")
+	default:
+		closeModalForm(p)
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			return
+		}
+		s.app.QueueUpdateDraw(func() {
+			expandTopics(s, p, chat)
+		})
+	}
+}
+
+func addTopicModal(s *appScreen, p *tview.Pages) func() {
 	return func() {
-		var chatUrl string
-		getChatForm := tview.NewForm()
-		getChatForm.AddInputField("Chat address", "", 50, nil, func(newUrl string) {
-			chatUrl = newUrl
+		var name string
+		getTopicForm := tview.NewForm()
+		getTopicForm.AddInputField("Topic name", "", 50, nil, func(newName string) {
+			name = newName
 		})
-		getChatForm.AddButton("Add", func() {
+		getTopicForm.AddButton("Add", func() {
 			go func() {
-				handleAddChat(s, p, chatUrl, "", "")
+				handleAddTopic(s, p, name)
 			}()
 		})
 
-		getChatForm.AddButton("Quit", func() {
+		getTopicForm.AddButton("Quit", func() {
 			closeModalForm(p)
 		})
-		getChatForm.SetButtonsAlign(tview.AlignCenter)
-		getChatForm.SetBorder(true).SetTitle("Add Chat")
-		modal := createModalForm(getChatForm, 7, 70)
+		getTopicForm.SetButtonsAlign(tview.AlignCenter)
+		getTopicForm.SetBorder(true).SetTitle("Add Topic")
+		modal := createModalForm(getTopicForm, 7, 70)
 		p.AddPage("modal", modal, true, true)
 	}
 }
 
-func (l *logLayout) highlightPanel(p tview.Primitive) error {
-	l.text.SetBorderColor(tcell.ColorWhite)
+func handleMergeTopic(s *appScreen, p *tview.Pages, topic string) {
+	chat, err := client.MergeTopic(topic)
 
-	switch p {
-	case l.text:
-		l.text.SetBorderColor(tcell.ColorGreen)
+	switch {
+	case errors.Is(err, client.ErrNothingToMerge):
+		closeModalForm(p)
+		addInfoModal(p, "Nothing to merge", "Topic has no new messages. "+
+			"Nothing to do.")
+	case errors.Is(err, client.ErrPushRejected):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot merge topic",
+			"Chat was changed by other members during merge several times in a row. "+
+				"Please try merge topic again.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during merge topic",
+			"Encountered unexpected error during merge topic. Please look into the logs.")
 	default:
-		return errors.New("invalid panel border")
+		closeModalForm(p)
+		chat, err = selectChat(s, chat)
+		if err != nil {
+			return
+		}
+		updateChatHeader(s, chat)
+		s.app.QueueUpdateDraw(func() {
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+			expandTopics(s, p, chat)
+		})
 	}
-	return nil
 }
 
-func (m *mainLayout) highlightPanel(p tview.Primitive) error {
-	m.chatList.SetBorderColor(tcell.ColorWhite)
-	m.chat.dialogue.SetBorderColor(tcell.ColorWhite)
-	m.chat.message.SetPlaceholderTextColor(tcell.ColorGray)
+func handleSquashTopic(s *appScreen, p *tview.Pages, topic, digest string) {
+	chat, err := client.SquashTopic(topic, digest)
 
-	switch p {
-	case m.chatList:
-		m.chatList.SetBorderColor(tcell.ColorGreen)
-	case m.chat.dialogue:
-		m.chat.dialogue.SetBorderColor(tcell.ColorGreen)
-	case m.chat.message:
-		m.chat.message.SetPlaceholderTextColor(tcell.ColorSilver)
+	switch {
+	case errors.Is(err, client.ErrNothingToMerge):
+		closeModalForm(p)
+		addInfoModal(p, "Nothing to squash", "Topic has no new messages. "+
+			"Nothing to do.")
+	case errors.Is(err, client.ErrPushRejected):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot squash topic",
+			"Chat was changed by other members during squash several times in a row. "+
+				"Please try squash topic again.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during squash topic",
+			"Encountered unexpected error during squash topic. Please look into the logs.")
 	default:
-		return errors.New("invalid panel border")
+		closeModalForm(p)
+		chat, err = selectChat(s, chat)
+		if err != nil {
+			return
+		}
+		updateChatHeader(s, chat)
+		s.app.QueueUpdateDraw(func() {
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+			expandTopics(s, p, chat)
+		})
 	}
-	return nil
 }
 
-func (s *appScreen) focusNextPanel() (tview.Primitive, error) {
-	if s.currPage == "main" {
-		focus := s.main.focus
-		f := (focus.curr + 1) % len(focus.panels)
-		panel, err := focus.setPanel(f)
-		if err != nil {
-			return nil, err
-		}
+func addSquashModal(s *appScreen, p *tview.Pages, topic string) {
+	digest, err := client.TopicDigest(topic)
+	if err != nil {
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during squash topic",
+			"Encountered unexpected error during collect topic messages. Please look into the logs.")
+		return
+	}
+
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
+		squashForm := tview.NewForm()
+		squashForm.AddTextView("",
+			fmt.Sprintf("All messages of topic %s will be replaced with a single digest in the main chat. "+
+				"Edit the digest text if needed.", topic),
+			0, 2, false, false)
+		squashForm.AddTextArea("Digest", digest, 0, 12, 0, func(text string) {
+			digest = text
+		})
+		squashForm.AddButton("Squash", func() {
+			go func() {
+				handleSquashTopic(s, p, topic, digest)
+			}()
+		})
+		squashForm.AddButton("Cancel", func() {
+			closeModalForm(p)
+		})
+
+		squashForm.SetButtonsAlign(tview.AlignCenter)
+		squashForm.SetBorder(true).SetTitle("Squash topic " + topic)
+		modal := createModalForm(squashForm, 22, 80)
+		p.AddPage("modal", modal, true, true)
+	})
+}
+
+func handleCloseTopic(s *appScreen, p *tview.Pages, topic string) {
+	chat, err := client.CloseTopic(topic)
+
+	switch {
+	case errors.Is(err, client.ErrArchiveExists):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot close topic",
+			"Archived topic with the same name already exists. "+
+				"Please reopen it first or merge this topic.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during close topic",
+			"Encountered unexpected error during close topic. Please look into the logs.")
+	default:
+		closeModalForm(p)
+		chat, err = selectChat(s, chat)
+		if err != nil {
+			return
+		}
+		updateChatHeader(s, chat)
+		s.app.QueueUpdateDraw(func() {
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+			expandTopics(s, p, chat)
+		})
+	}
+}
+
+func handleReopenTopic(s *appScreen, p *tview.Pages, topic string) {
+	_, err := client.ReopenTopic(topic)
+
+	switch {
+	case errors.Is(err, client.ErrTopicExists):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot reopen topic",
+			"Topic with the same name already exists. "+
+				"Please merge or close it first.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during reopen topic",
+			"Encountered unexpected error during reopen topic. Please look into the logs.")
+	default:
+		closeModalForm(p)
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			return
+		}
+		s.app.QueueUpdateDraw(func() {
+			expandTopics(s, p, chat)
+		})
+	}
+}
+
+func addArchivedTopicsModal(s *appScreen, p *tview.Pages, chat client.Chat) {
+	topics, err := client.ListArchivedTopics(chat)
+	if err != nil {
+		addInfoModal(p, "Unexpected error during list archived topics",
+			"Encountered unexpected error during list archived topics. Please look into the logs.")
+		return
+	}
+
+	s.app.QueueUpdateDraw(func() {
+		archiveList := tview.NewList()
+		for _, t := range topics {
+			topic := t
+			archiveList.AddItem(chatListUpperStr(topic.Name, chatListRelativeTime(topic.LastMsg.Time)),
+				chatListBottomStr(client.VisibleName(chat, topic.LastMsg.Author), previewText(topic.LastMsg), topic.MsgNum), 0,
+				func() {
+					go func() {
+						handleReopenTopic(s, p, topic.Name)
+					}()
+				})
+		}
+		archiveList.AddItem("Return", "", 0, func() {
+			closeModalForm(p)
+		})
+
+		archiveList.SetBorder(true).SetTitle("Archived topics, press Enter to reopen")
+		modal := createModalForm(archiveList, 20, 70)
+		p.AddPage("modal", modal, true, true)
+	})
+}
+
+func addTopicActionsModal(s *appScreen, p *tview.Pages, topic string) {
+	topicForm := tview.NewForm()
+	topicForm.AddTextView("",
+		fmt.Sprintf("What to do with topic %s?", topic),
+		0, 0, false, false)
+	topicForm.AddButton("Merge", func() {
+		go func() {
+			handleMergeTopic(s, p, topic)
+		}()
+	})
+	topicForm.AddButton("Squash", func() {
+		go func() {
+			addSquashModal(s, p, topic)
+		}()
+	})
+	topicForm.AddButton("Close", func() {
+		go func() {
+			handleCloseTopic(s, p, topic)
+		}()
+	})
+	topicForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
+
+	topicForm.SetButtonsAlign(tview.AlignCenter)
+	topicForm.SetBorder(true).SetTitle("Topic " + topic)
+	modal := createModalForm(topicForm, 7, 70)
+	p.AddPage("modal", modal, true, true)
+}
+
+func addChatModal(s *appScreen, p *tview.Pages) func() {
+	return func() {
+		var chatUrl string
+		getChatForm := tview.NewForm()
+		getChatForm.AddInputField("Chat address", "", 50, nil, func(newUrl string) {
+			chatUrl = newUrl
+		})
+		getChatForm.AddButton("Add", func() {
+			go func() {
+				handleAddChat(s, p, chatUrl, "", "")
+			}()
+		})
+
+		getChatForm.AddButton("Quit", func() {
+			closeModalForm(p)
+		})
+		getChatForm.SetButtonsAlign(tview.AlignCenter)
+		getChatForm.SetBorder(true).SetTitle("Add Chat")
+		modal := createModalForm(getChatForm, 7, 70)
+		p.AddPage("modal", modal, true, true)
+	}
+}
+
+func (l *logLayout) highlightPanel(p tview.Primitive) error {
+	l.text.SetBorderColor(tcell.ColorWhite)
+
+	switch p {
+	case l.text:
+		l.text.SetBorderColor(tcell.ColorGreen)
+	default:
+		return errors.New("invalid panel border")
+	}
+	return nil
+}
+
+func (m *mainLayout) highlightPanel(p tview.Primitive) error {
+	m.chatList.SetBorderColor(tcell.ColorWhite)
+	m.chat.dialogue.SetBorderColor(tcell.ColorWhite)
+	m.chat.message.SetPlaceholderStyle(composerStyle(tcell.ColorGray))
+
+	switch p {
+	case m.chatList:
+		m.chatList.SetBorderColor(tcell.ColorGreen)
+	case m.chat.dialogue:
+		m.chat.dialogue.SetBorderColor(tcell.ColorGreen)
+	case m.chat.message:
+		m.chat.message.SetPlaceholderStyle(composerStyle(tcell.ColorSilver))
+	default:
+		return errors.New("invalid panel border")
+	}
+	return nil
+}
+
+func (l *membersLayout) highlightPanel(p tview.Primitive) error {
+	l.list.SetBorderColor(tcell.ColorWhite)
+
+	switch p {
+	case l.list:
+		l.list.SetBorderColor(tcell.ColorGreen)
+	case l.button:
+	default:
+		return errors.New("invalid panel border")
+	}
+	return nil
+}
+
+func (l *searchLayout) highlightPanel(p tview.Primitive) error {
+	l.query.SetBorderColor(tcell.ColorWhite)
+	l.results.SetBorderColor(tcell.ColorWhite)
+
+	switch p {
+	case l.query:
+		l.query.SetBorderColor(tcell.ColorGreen)
+	case l.results:
+		l.results.SetBorderColor(tcell.ColorGreen)
+	case l.button:
+	default:
+		return errors.New("invalid panel border")
+	}
+	return nil
+}
+
+func (s *appScreen) focusNextPanel() (tview.Primitive, error) {
+	if s.currPage == "main" {
+		focus := s.main.focus
+		f := (focus.curr + 1) % len(focus.panels)
+		panel, err := focus.setPanel(f)
+		if err != nil {
+			return nil, err
+		}
+
+		s.app.SetFocus(panel)
+		s.main.highlightPanel(panel)
+		return panel, nil
+
+	} else if s.currPage == "log" {
+		focus := s.log.focus
+		f := (focus.curr + 1) % len(focus.panels)
+		panel, err := focus.setPanel(f)
+		if err != nil {
+			return nil, err
+		}
+
+		s.app.SetFocus(panel)
+		s.log.highlightPanel(panel)
+		return panel, nil
+
+	} else if s.currPage == "members" {
+		focus := s.members.focus
+		f := (focus.curr + 1) % len(focus.panels)
+		panel, err := focus.setPanel(f)
+		if err != nil {
+			return nil, err
+		}
+
+		s.app.SetFocus(panel)
+		s.members.highlightPanel(panel)
+		return panel, nil
+
+	} else if s.currPage == "search" {
+		focus := s.search.focus
+		f := (focus.curr + 1) % len(focus.panels)
+		panel, err := focus.setPanel(f)
+		if err != nil {
+			return nil, err
+		}
+
+		s.app.SetFocus(panel)
+		s.search.highlightPanel(panel)
+		return panel, nil
+
+	} else {
+		return nil, errors.New("wrong current page")
+	}
+}
+
+func showMembers(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		if _, err := client.GetCurrChat(); err != nil {
+			addInfoModal(p, "No chat selected",
+				"Choose a chat in the chat list first.")
+			return nil
+		}
+
+		fillMembers(s, p)
+		p.SwitchToPage("members")
+		s.currPage, _ = p.GetFrontPage()
+
+		panel, err := s.members.focus.setPanel(0)
+		if err == nil {
+			s.app.SetFocus(panel)
+			s.members.highlightPanel(panel)
+		}
+		return nil
+	}
+}
+
+func showTopicActions(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		chat, err := client.GetCurrChat()
+		if err != nil || chat.Topic == "" {
+			addInfoModal(p, "No topic selected",
+				"Choose a topic under the chat in the chat list first.")
+			return nil
+		}
+		addTopicActionsModal(s, p, chat.Topic)
+		return nil
+	}
+}
+
+func showAttachModal(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		if _, err := client.GetCurrChat(); err != nil {
+			addInfoModal(p, "No chat selected",
+				"Choose a chat in the chat list first.")
+			return nil
+		}
+		addAttachModal(s, p)
+		return nil
+	}
+}
+
+func showNameModal(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			addInfoModal(p, "No chat selected",
+				"Choose a chat in the chat list first.")
+			return nil
+		}
+		addNameModal(s, p, chat)
+		return nil
+	}
+}
+
+func showLeaveModal(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			addInfoModal(p, "No chat selected",
+				"Choose a chat in the chat list first.")
+			return nil
+		}
+		addLeaveModal(s, p, chat)
+		return nil
+	}
+}
+
+func switchToLogs(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		p.SwitchToPage("log")
+		s.currPage, _ = p.GetFrontPage()
+		return event
+	}
+}
+
+func switchToSearch(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		p.SwitchToPage("search")
+		s.currPage, _ = p.GetFrontPage()
+
+		panel, err := s.search.focus.setPanel(0)
+		if err == nil {
+			s.app.SetFocus(panel)
+			s.search.highlightPanel(panel)
+		}
+		return nil
+	}
+}
+
+func quitApp(s *appScreen) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		s.app.Stop()
+		return nil
+	}
+}
+
+func switchPanel(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		panel, err := s.focusNextPanel()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		chat, err := client.GetCurrChat()
+		if err != nil {
+			return nil
+		}
+
+		if s.currPage == "main" &&
+			(panel == s.main.chat.dialogue || panel == s.main.chat.message) &&
+			chat.NonReadMsgNum != 0 {
+			chat, err = client.ClearNonReadMsgsForCurrChat()
+			if err != nil {
+				return nil
+			}
+			updChatInList(s, p, getChatListChatIndex(s, chat), chat)
+		}
+		return nil
+	}
+}
+
+type cmd struct {
+	name string
+	perm client.Permission
+	f    func(event *tcell.EventKey) *tcell.EventKey
+}
+
+var runeCmds map[rune]cmd
+var keyCmds map[tcell.Key]cmd
+
+// runeCmdsOrder keeps the commands in place, when some are hidden
+var runeCmdsOrder []rune
+
+func addRuneCmd(r rune, c cmd) {
+	runeCmds[r] = c
+	runeCmdsOrder = append(runeCmdsOrder, r)
+}
+
+// permitted reports whether my role in the current chat has the permission.
+// Without a chat selected everything is permitted, as commands tell
+// to choose a chat themselves
+func permitted(perm client.Permission) bool {
+	chat, err := client.GetCurrChat()
+	if err != nil {
+		return true
+	}
+	return client.Allowed(chat, perm)
+}
+
+func initCommands(s *appScreen, p *tview.Pages) {
+	runeCmds = make(map[rune]cmd)
+	runeCmdsOrder = nil
+	addRuneCmd('m', cmd{name: "Members", perm: client.PermRead, f: showMembers(s, p)})
+	addRuneCmd('t', cmd{name: "Topic", perm: client.PermWrite, f: showTopicActions(s, p)})
+	addRuneCmd('a', cmd{name: "Attach", perm: client.PermWrite, f: showAttachModal(s, p)})
+	addRuneCmd('n', cmd{name: "Name", perm: client.PermWrite, f: showNameModal(s, p)})
+	addRuneCmd('x', cmd{name: "Leave", perm: client.PermRead, f: showLeaveModal(s, p)})
+	addRuneCmd('/', cmd{name: "Search", perm: client.PermRead, f: switchToSearch(s, p)})
+	addRuneCmd('l', cmd{name: "Logs", perm: client.PermRead, f: switchToLogs(s, p)})
+	addRuneCmd('q', cmd{name: "Quit", perm: client.PermRead, f: quitApp(s)})
+
+	keyCmds = make(map[tcell.Key]cmd)
+	keyCmds[tcell.KeyTab] = cmd{name: "", f: switchPanel(s, p)}
+}
+
+func setKeyboardHandler(s *appScreen, p *tview.Pages) {
+	s.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		client.Touch()
+
+		frontPage, _ := p.GetFrontPage()
+		if frontPage == "modal" {
+			return event
+		}
+
+		cmd, ok := keyCmds[event.Key()]
+		if ok {
+			return cmd.f(event)
+		}
+
+		if (s.currPage != "main") || (s.main.focus.curr == msgFocusNum) {
+			return event
+		}
+
+		cmd, ok = runeCmds[event.Rune()]
+		if ok && permitted(cmd.perm) {
+			return cmd.f(event)
+		}
+
+		return event
+	})
+}
+
+func createCommands(s *appScreen, p *tview.Pages) *tview.Flex {
+	initCommands(s, p)
+
+	cmdContainer := tview.NewFlex()
+	fillCommands(cmdContainer)
+	cmdContainer.SetDirection(tview.FlexColumn).SetBorder(true)
+
+	setKeyboardHandler(s, p)
+
+	return cmdContainer
+}
+
+// fillCommands lists the commands permitted in the current chat
+func fillCommands(cmdContainer *tview.Flex) {
+	cmdContainer.Clear()
+	for _, r := range runeCmdsOrder {
+		cmd := runeCmds[r]
+		if !permitted(cmd.perm) {
+			continue
+		}
+		list := tview.NewList().
+			AddItem(cmd.name, "", r, nil)
+		cmdContainer.AddItem(list, 0, 1, true)
+	}
+}
+
+func isDifferentDay(d1, d2 time.Time) bool {
+	year1, month1, day1 := d1.Date()
+	year2, month2, day2 := d2.Date()
+
+	return year1 != year2 || month1 != month2 || day1 != day2
+}
+
+var prevDate time.Time
+
+func newDate(t time.Time) bool {
+	if (prevDate == (time.Time{})) || isDifferentDay(prevDate, t) {
+		prevDate = t
+		return true
+	}
+	return false
+}
+
+func dialogueNewDate(t time.Time) string {
+	if time.Now().Year() != t.Year() {
+		return t.Format("January 2, 2006")
+	}
+	return t.Format("January 2")
+}
+
+func splitString(s, open, clos string, splitLen, padding int) []string {
+	var chunks []string
+
+	for i := 0; i < len(s); i += splitLen {
+		end := i + splitLen
+		fillSpaces := 0
+		if end > len(s) {
+			fillSpaces = end - len(s)
+			end = len(s)
+		}
+		chunks = append(chunks, fmt.Sprintf("%*s", padding, open+s[i:end]+strings.Repeat(" ", fillSpaces)+clos))
+	}
+
+	return chunks
+}
+
+func getColorFromUsername(username string) string {
+	hash := sha256.New()
+	hash.Write([]byte(username))
+	hashSum := hash.Sum(nil)
+
+	r := hashSum[0]
+	g := hashSum[1]
+	b := hashSum[2]
+
+	color := fmt.Sprintf("#%02x%02x%02x", r, g, b)
+	return color
+}
+
+var dialogue *log.Logger
+
+// dialogueState keeps printed messages, so the dialogue can be redrawn
+// when a message is expanded or selected
+type dialogueState struct {
+	mu       sync.Mutex
+	msgs     []client.Message
+	expanded map[string]bool
+	selected int
+	hasOlder bool
+	// chat resolves authors to their visible names
+	chat client.Chat
+	// firstUnread is the message the "new messages" separator is drawn above
+	firstUnread string
+	// parents are the messages replied to from outside the loaded pages,
+	// fetching are the ones being loaded for that
+	parents  map[string]client.Message
+	fetching map[string]bool
+}
+
+var dlg = dialogueState{
+	expanded: make(map[string]bool),
+	selected: -1,
+	parents:  make(map[string]client.Message),
+	fetching: make(map[string]bool),
+}
+
+func formatMergeEvent(m client.Message, expanded bool) string {
+	marker := "▸"
+	text := strings.SplitN(m.Text, "\n", 2)[0]
+	if expanded {
+		marker = "▾"
+		text = m.Text
+	}
+
+	return fmt.Sprintf("[:blue]%s Topic %s merged by %s [%s][-:-:-:-]\n%s\n",
+		marker, tview.Escape(m.MergedTopic), tview.Escape(authorName(m.Author)), m.Time.Format("15:04"), tview.Escape(text))
+}
+
+func formatQuote(parent client.Message) string {
+	text := strings.SplitN(previewText(parent), "\n", 2)[0]
+	return fmt.Sprintf("[gray]│ %s: %s[-]\n", tview.Escape(authorName(parent.Author)), tview.Escape(text))
+}
+
+func formatMsg(m client.Message, parent *client.Message, username string, expanded, seen bool) string {
+	if m.MergedTopic != "" {
+		return formatMergeEvent(m, expanded)
+	}
+
+	usernameColor := getColorFromUsername(m.Author)
+
+	bgColor := ""
+	if m.Author == username {
+		bgColor = "gray"
+	}
+
+	quote := ""
+	if parent != nil {
+		quote = formatQuote(*parent)
+	}
+
+	edited := ""
+	if m.Edited {
+		edited = " (edited)"
+	}
+	if seen {
+		edited += " ✓✓"
+	}
+	if m.Pending {
+		edited += " (pending)"
+	}
+
+	text := tview.Escape(m.Text)
+	if m.Deleted {
+		text = "[gray::i]" + deletedMsgText + "[-::-]"
+	} else if m.Attachment != "" {
+		att := formatAttachment(m)
+		if text != "" {
+			att = text + "\n" + att
+		}
+		text = att
+	}
+
+	return fmt.Sprintf("%s[%s:%s:b]%s [%s]%s[-::-:-]%s\n%s[-:-:-:-]\n%s",
+		quote, usernameColor, bgColor, tview.Escape(authorName(m.Author)), m.Time.Format("15:04"), edited,
+		formatSignature(m), text, formatReactions(m))
+}
+
+// formatSignature shows whether the message is signed by a key of
+// a member, and warns if that member is not the author
+func formatSignature(m client.Message) string {
+	switch m.Signature {
+	case client.SignatureVerified:
+		badge := " [green]✔ verified[-]"
+		if m.Signer != m.Author {
+			badge += fmt.Sprintf(" [yellow]⚠ signed by %s[-]", tview.Escape(authorName(m.Signer)))
+		}
+		return badge
+	case client.SignatureUnverified:
+		return " [red]✘ unverified[-]"
+	default:
+		return ""
+	}
+}
+
+// formatAttachment shows the file attached to the message
+func formatAttachment(m client.Message) string {
+	return fmt.Sprintf("[::u]📎 %s (%s)[::-]", tview.Escape(client.AttachmentName(m)), formatSize(m.AttachmentSize))
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size < 1<<10:
+		return fmt.Sprintf("%d B", size)
+	case size < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	}
+}
+
+// formatReactions shows how many members reacted with each emoji,
+// the most popular first
+func formatReactions(m client.Message) string {
+	if len(m.Reactions) == 0 {
+		return ""
+	}
+
+	counts := make(map[string]int)
+	var emojis []string
+	for _, emoji := range m.Reactions {
+		if counts[emoji] == 0 {
+			emojis = append(emojis, emoji)
+		}
+		counts[emoji]++
+	}
+	sort.Slice(emojis, func(i, j int) bool {
+		if counts[emojis[i]] != counts[emojis[j]] {
+			return counts[emojis[i]] > counts[emojis[j]]
+		}
+		return emojis[i] < emojis[j]
+	})
+
+	var reactions []string
+	for _, emoji := range emojis {
+		reactions = append(reactions, fmt.Sprintf("%s %d", tview.Escape(emoji), counts[emoji]))
+	}
+	return "[gray]" + strings.Join(reactions, "  ") + "[-]\n"
+}
+
+// updateVisibleNames redraws the dialogue, if members of its chat
+// changed their visible names
+func updateVisibleNames(s *appScreen, chat client.Chat) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	changed := false
+	for _, m := range chat.Members {
+		if client.VisibleName(dlg.chat, m.Username) != client.VisibleName(chat, m.Username) {
+			changed = true
+		}
+	}
+	dlg.chat = chat
+	if changed {
+		writeDialogue(s)
+	}
+}
+
+// authorName returns the visible name of the author in the chat of
+// the dialogue. The dialogue lock must be held
+func authorName(username string) string {
+	return client.VisibleName(dlg.chat, username)
+}
+
+// findParent returns the message replied to. The one outside the loaded
+// pages is loaded in the background, the reply is drawn without the quote
+// until then. The dialogue lock must be held
+func findParent(s *appScreen, m client.Message) *client.Message {
+	if m.ReplyTo == "" {
+		return nil
+	}
+
+	for i := range dlg.msgs {
+		if dlg.msgs[i].Hash == m.ReplyTo {
+			return &dlg.msgs[i]
+		}
+	}
+
+	if parent, ok := dlg.parents[m.ReplyTo]; ok {
+		return &parent
+	}
+
+	if !dlg.fetching[m.ReplyTo] {
+		dlg.fetching[m.ReplyTo] = true
+		go fetchParent(s, m.ReplyTo)
+	}
+	return nil
+}
+
+// fetchParent loads the message replied to and draws the dialogue again
+// with its quote
+func fetchParent(s *appScreen, hash string) {
+	parent, err := client.GetMsg(hash)
+
+	dlg.mu.Lock()
+	delete(dlg.fetching, hash)
+	if err != nil {
+		dlg.mu.Unlock()
+		return
+	}
+	dlg.parents[hash] = parent
+	writeDialogue(s)
+	dlg.mu.Unlock()
+}
+
+func writeMsg(s *appScreen, m client.Message, username string, expanded bool) {
+	if newDate(m.Time) {
+		dialogue.Println("[:blue]---------->>> " + dialogueNewDate(m.Time) + "[-:-:-:-]\n")
+	}
+
+	if m.Hash == dlg.firstUnread {
+		dialogue.Println("[red]— new messages —[-]")
+	}
+
+	// Only my latest message shows whether it was seen
+	seen := len(m.SeenBy) > 0 && m.Hash == lastOwnMsg(username)
+	dialogue.Println(fmt.Sprintf(`["%s"]%s[""]`, m.Hash, formatMsg(m, findParent(s, m), username, expanded, seen)))
+}
+
+// lastOwnMsg returns the hash of my latest message in the dialogue.
+// The dialogue lock must be held
+func lastOwnMsg(username string) string {
+	for i := len(dlg.msgs) - 1; i >= 0; i-- {
+		if dlg.msgs[i].Author == username && dlg.msgs[i].MergedTopic == "" {
+			return dlg.msgs[i].Hash
+		}
+	}
+	return ""
+}
+
+func printMsg(s *appScreen, m client.Message) {
+	username, err := client.GetUserName()
+	if err != nil {
+		return
+	}
+
+	dlg.mu.Lock()
+	for i := range dlg.msgs {
+		// Message was edited, so redraw it in place
+		if dlg.msgs[i].Hash == m.Hash {
+			dlg.msgs[i] = m
+			dlg.mu.Unlock()
+			redrawDialogue(s)
+			return
+		}
+
+		// Pending message was put after the ones pushed first
+		if m.MsgId != "" && dlg.msgs[i].MsgId == m.MsgId {
+			dlg.msgs = append(dlg.msgs[:i], dlg.msgs[i+1:]...)
+			dlg.msgs = append(dlg.msgs, m)
+			writeDialogue(s)
+			dlg.mu.Unlock()
+			return
+		}
+	}
+	// Message is from the history not loaded yet, it shows up with its page.
+	// It may be quoted by a loaded reply though
+	if len(dlg.msgs) > 0 && m.Time.Before(dlg.msgs[0].Time) {
+		if _, ok := dlg.parents[m.Hash]; ok {
+			dlg.parents[m.Hash] = m
+			writeDialogue(s)
+		}
+		dlg.mu.Unlock()
+		return
+	}
+	dlg.msgs = append(dlg.msgs, m)
+	if m.Author == username {
+		// My previous message loses its seen mark
+		writeDialogue(s)
+		dlg.mu.Unlock()
+		return
+	}
+	writeMsg(s, m, username, dlg.expanded[m.Hash])
+	selected := dlg.selected >= 0
+	dlg.mu.Unlock()
+
+	if !selected {
+		s.main.chat.dialogue.ScrollToEnd()
+	}
+}
+
+const msgPageSize int = 100
+
+// loadLatestMsgs prints the latest page of messages of the current chat
+// and jumps to the first unread one
+func loadLatestMsgs(s *appScreen, chat client.Chat) {
+	msgs, err := client.GetLatestMsgs(msgPageSize)
+	if err != nil {
+		return
+	}
+
+	username, err := client.GetUserName()
+	if err != nil {
+		return
+	}
+
+	dlg.mu.Lock()
+	dlg.chat = chat
+	dlg.msgs = append(dlg.msgs, msgs...)
+	dlg.hasOlder = len(msgs) == msgPageSize
+	for _, m := range msgs {
+		writeMsg(s, m, username, dlg.expanded[m.Hash])
+	}
+
+	if chat.NonReadMsgNum > 0 {
+		jumpToFirstUnread(s, chat)
+		dlg.mu.Unlock()
+		return
+	}
+	dlg.mu.Unlock()
+
+	s.main.chat.dialogue.ScrollToEnd()
+}
+
+// jumpToFirstUnread selects the message following the last read one and
+// draws the separator above it. Older pages are loaded until the last
+// read message shows up. The dialogue lock must be held
+func jumpToFirstUnread(s *appScreen, chat client.Chat) {
+	last := msgIndex(chat.LastRead)
+	for last < 0 && len(dlg.msgs) < chat.NonReadMsgNum+msgPageSize && loadOlderMsgs(s) {
+		last = msgIndex(chat.LastRead)
+	}
+
+	first := last + 1
+	if last < 0 {
+		// Last read commit is folded into its target, e.g. it is an edit
+		first = max(0, len(dlg.msgs)-chat.NonReadMsgNum)
+	}
+
+	if first >= len(dlg.msgs) {
+		dlg.selected = -1
+	} else {
+		dlg.firstUnread = dlg.msgs[first].Hash
+		dlg.selected = first
+	}
+	writeDialogue(s)
+}
+
+// loadOlderMsgs puts the page of messages preceding the loaded ones on top
+// of the dialogue and selects the last of them. The dialogue lock must be held
+func loadOlderMsgs(s *appScreen) bool {
+	if !dlg.hasOlder || len(dlg.msgs) == 0 {
+		return false
+	}
+
+	older, err := client.GetMsgsBefore(dlg.msgs[0].Hash, msgPageSize)
+	if err != nil || len(older) == 0 {
+		dlg.hasOlder = false
+		return false
+	}
+	dlg.hasOlder = len(older) == msgPageSize
+
+	dlg.msgs = append(older, dlg.msgs...)
+	if dlg.selected >= 0 {
+		dlg.selected += len(older)
+	} else {
+		dlg.selected = len(older) - 1
+	}
+	writeDialogue(s)
+	return true
+}
+
+func redrawDialogue(s *appScreen) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	writeDialogue(s)
+}
+
+// writeDialogue prints all the messages of the dialogue again.
+// The dialogue lock must be held
+func writeDialogue(s *appScreen) {
+	username, err := client.GetUserName()
+	if err != nil {
+		return
+	}
+
+	s.main.chat.dialogue.Clear()
+	prevDate = time.Time{}
+	for _, m := range dlg.msgs {
+		writeMsg(s, m, username, dlg.expanded[m.Hash])
+	}
+
+	if dlg.selected >= 0 {
+		s.main.chat.dialogue.Highlight(dlg.msgs[dlg.selected].Hash).ScrollToHighlight()
+	} else {
+		s.main.chat.dialogue.ScrollToEnd()
+	}
+}
+
+// selectMsg moves the selection in the dialogue by delta messages,
+// starting from the last message. Moving up from the first message
+// loads older ones
+func selectMsg(s *appScreen, delta int) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if len(dlg.msgs) == 0 {
+		return
+	}
+
+	if dlg.selected == 0 && delta < 0 {
+		loadOlderMsgs(s)
+	}
+
+	if dlg.selected < 0 {
+		dlg.selected = len(dlg.msgs) - 1
+	} else {
+		dlg.selected = max(0, min(len(dlg.msgs)-1, dlg.selected+delta))
+	}
+	s.main.chat.dialogue.Highlight(dlg.msgs[dlg.selected].Hash).ScrollToHighlight()
+}
+
+// selectMsgByHash selects the message in the dialogue, if it is printed.
+// The dialogue lock must be held
+func selectMsgByHash(s *appScreen, hash string) bool {
+	i := msgIndex(hash)
+	if i < 0 {
+		return false
+	}
+
+	dlg.selected = i
+	s.main.chat.dialogue.Highlight(hash).ScrollToHighlight()
+	return true
+}
+
+// msgIndex returns the index of the printed message, or -1.
+// The dialogue lock must be held
+func msgIndex(hash string) int {
+	for i := range dlg.msgs {
+		if dlg.msgs[i].Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func getSelectedMsg() (client.Message, bool) {
+	dlg.mu.Lock()
+	defer dlg.mu.Unlock()
+
+	if dlg.selected < 0 || dlg.selected >= len(dlg.msgs) {
+		return client.Message{}, false
+	}
+	return dlg.msgs[dlg.selected], true
+}
+
+// startReply makes the next sent message a reply to the selected one
+func startReply(s *appScreen) {
+	m, ok := getSelectedMsg()
+	if !ok || m.MergedTopic != "" {
+		return
+	}
+
+	resetComposer(s)
+	s.main.chat.replyTo = &m
+	name := m.Author
+	if chat, err := client.GetCurrChat(); err == nil {
+		name = client.VisibleName(chat, m.Author)
+	}
+	s.main.chat.message.SetLabel(fmt.Sprintf("↪ %s: ", name))
+	focusComposer(s)
+}
+
+// startEdit puts the text of my selected message into the composer,
+// so the next sent text replaces it
+func startEdit(s *appScreen) {
+	m, ok := getSelectedMsg()
+	if !ok || m.MergedTopic != "" || m.Deleted {
+		return
+	}
+
+	username, err := client.GetUserName()
+	if err != nil || m.Author != username {
+		return
+	}
+
+	resetComposer(s)
+	s.main.chat.editing = &m
+	s.main.chat.message.SetLabel("✎ edit: ")
+	s.main.chat.message.SetText(m.Text, true)
+	focusComposer(s)
+}
+
+func handleRetractMsg(s *appScreen, p *tview.Pages, hash string) {
+	chat, err := client.RetractMsg(hash)
+
+	switch {
+	case errors.Is(err, client.ErrNotMsgAuthor), errors.Is(err, client.ErrNotPermitted):
+		closeModalForm(p)
+		addInfoModal(p, "Cannot delete message", "Only the author or an admin can delete the message.")
+	case err != nil:
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during delete message",
+			"Encountered unexpected error during delete message. Please look into the logs.")
+	default:
+		closeModalForm(p)
+		updateChatHeader(s, chat)
+		s.app.QueueUpdateDraw(func() {
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+		})
+	}
+}
+
+// addRetractModal asks to confirm deletion of the selected message,
+// which is mine or, for moderators, of anyone
+func addRetractModal(s *appScreen, p *tview.Pages) {
+	m, ok := getSelectedMsg()
+	if !ok || m.MergedTopic != "" || m.Deleted {
+		return
+	}
+
+	username, err := client.GetUserName()
+	if err != nil {
+		return
+	}
+	if !permitted(client.PermWrite) || (m.Author != username && !permitted(client.PermModerate)) {
+		return
+	}
+
+	retractForm := tview.NewForm()
+	retractForm.AddTextView("",
+		fmt.Sprintf("Delete message \"%s\" for all members of the chat?", strings.SplitN(m.Text, "\n", 2)[0]),
+		0, 0, false, false)
+	retractForm.AddButton("Delete", func() {
+		go func() {
+			handleRetractMsg(s, p, m.Hash)
+		}()
+	})
+	retractForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
 
-		s.app.SetFocus(panel)
-		s.main.highlightPanel(panel)
-		return panel, nil
+	retractForm.SetButtonsAlign(tview.AlignCenter)
+	retractForm.SetBorder(true).SetTitle("Delete message")
+	modal := createModalForm(retractForm, 9, 70)
+	p.AddPage("modal", modal, true, true)
+}
 
-	} else if s.currPage == "log" {
-		focus := s.log.focus
-		f := (focus.curr + 1) % len(focus.panels)
-		panel, err := focus.setPanel(f)
-		if err != nil {
-			return nil, err
+func handleSendAttachment(s *appScreen, p *tview.Pages, filePath, text string) {
+	chat, err := client.SendAttachment(filePath, text)
+
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
+		switch {
+		case errors.Is(err, client.ErrAttachmentSize):
+			addInfoModal(p, "Cannot attach file", "The file is too big to attach, 10 MB at most.")
+		case errors.Is(err, fs.ErrNotExist):
+			addInfoModal(p, "Cannot attach file", fmt.Sprintf("File %s does not exist.", filePath))
+		case err != nil:
+			addInfoModal(p, "Unexpected error during send attachment",
+				"Encountered unexpected error during send attachment. Please look into the logs.")
+		default:
+			updateChatHeader(s, chat)
+			updChatInList(s, p, s.main.selectChatIndex, chat)
 		}
+	})
+}
 
-		s.app.SetFocus(panel)
-		s.log.highlightPanel(panel)
-		return panel, nil
+// addAttachModal asks for the local file to send to the current chat
+func addAttachModal(s *appScreen, p *tview.Pages) {
+	var filePath, text string
+	attachForm := tview.NewForm()
+	attachForm.AddInputField("File", "", 50, nil, func(newPath string) {
+		filePath = newPath
+	})
+	attachForm.AddInputField("Message", "", 50, nil, func(newText string) {
+		text = newText
+	})
+	attachForm.AddButton("Send", func() {
+		go func() {
+			handleSendAttachment(s, p, filePath, text)
+		}()
+	})
+	attachForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
 
-	} else {
-		return nil, errors.New("wrong current page")
-	}
+	attachForm.SetButtonsAlign(tview.AlignCenter)
+	attachForm.SetBorder(true).SetTitle("Attach file")
+	modal := createModalForm(attachForm, 9, 70)
+	p.AddPage("modal", modal, true, true)
 }
 
-func showMembers() func(event *tcell.EventKey) *tcell.EventKey {
-	return func(event *tcell.EventKey) *tcell.EventKey { return event }
+// addNameModal asks for my visible name in the chat
+func addNameModal(s *appScreen, p *tview.Pages, chat client.Chat) {
+	username, err := client.GetUserName()
+	if err != nil {
+		return
+	}
+
+	name := client.VisibleName(chat, username)
+	nameForm := tview.NewForm()
+	nameForm.AddInputField("Name", name, 50, nil, func(newName string) {
+		name = newName
+	})
+	nameForm.AddButton("Save", func() {
+		go func() {
+			handleSetVisibleName(s, p, name)
+		}()
+	})
+	nameForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
+
+	nameForm.SetButtonsAlign(tview.AlignCenter)
+	nameForm.SetBorder(true).SetTitle("My name in " + chat.Name)
+	modal := createModalForm(nameForm, 7, 70)
+	p.AddPage("modal", modal, true, true)
 }
 
-func switchToLogs(s *appScreen, p *tview.Pages) func(event *tcell.EventKey) *tcell.EventKey {
-	return func(event *tcell.EventKey) *tcell.EventKey {
-		p.SwitchToPage("log")
-		s.currPage, _ = p.GetFrontPage()
-		return event
-	}
+func handleSetVisibleName(s *appScreen, p *tview.Pages, name string) {
+	chat, err := client.SetVisibleName(name)
+
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
+		switch {
+		case errors.Is(err, client.ErrInvalidName):
+			addInfoModal(p, "Invalid name", "Name should not be empty and should fit in one line.")
+		case errors.Is(err, client.ErrTopicSelected):
+			addInfoModal(p, "Topic selected",
+				"Name is kept in the main chat. Choose # main under the chat and try again.")
+		case err != nil:
+			addInfoModal(p, "Unexpected error during set name",
+				"Encountered unexpected error during set name. Please look into the logs.")
+		default:
+			updChatInList(s, p, s.main.selectChatIndex, chat)
+			updateChatHeader(s, chat)
+			go updateVisibleNames(s, chat)
+		}
+	})
 }
 
-func quitApp(s *appScreen) func(event *tcell.EventKey) *tcell.EventKey {
-	return func(event *tcell.EventKey) *tcell.EventKey {
-		s.app.Stop()
-		return nil
-	}
+// addLeaveModal asks to confirm leaving the chat
+func addLeaveModal(s *appScreen, p *tview.Pages, chat client.Chat) {
+	removeMe := true
+	leaveForm := tview.NewForm()
+	leaveForm.AddTextView("",
+		fmt.Sprintf("Leave chat %s? Its messages are deleted from this computer.", chat.Name),
+		0, 0, false, false)
+	leaveForm.AddCheckbox("Remove me from members", removeMe, func(checked bool) {
+		removeMe = checked
+	})
+	leaveForm.AddButton("Leave", func() {
+		go func() {
+			handleLeaveChat(s, p, chat, removeMe)
+		}()
+	})
+	leaveForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
+
+	leaveForm.SetButtonsAlign(tview.AlignCenter)
+	leaveForm.SetBorder(true).SetTitle("Leave " + chat.Name)
+	modal := createModalForm(leaveForm, 9, 70)
+	p.AddPage("modal", modal, true, true)
 }
 
-func switchPanel(s *appScreen) func(event *tcell.EventKey) *tcell.EventKey {
-	return func(event *tcell.EventKey) *tcell.EventKey {
-		panel, err := s.focusNextPanel()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		chat, err := client.GetCurrChat()
+func handleLeaveChat(s *appScreen, p *tview.Pages, chat client.Chat, removeMe bool) {
+	err := client.LeaveChat(chat, removeMe)
+
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
 		if err != nil {
-			return nil
+			addInfoModal(p, "Unexpected error during leave chat",
+				"Encountered unexpected error during leave chat. Please look into the logs. "+
+					"To leave without telling the members, uncheck \"Remove me from members\".")
+			return
 		}
 
-		if s.currPage == "main" &&
-			(panel == s.main.chat.dialogue || panel == s.main.chat.message) &&
-			chat.NonReadMsgNum != 0 {
-			chat, err = client.ClearNonReadMsgsForCurrChat()
-			if err != nil {
-				return nil
-			}
-			updChatInList(s, getChatListChatIndex(s, chat), chat)
-		}
-		return nil
-	}
+		collapseTopics(s)
+		s.main.chatList.RemoveItem(getChatListChatIndex(s, chat))
+		s.main.selectChatIndex = 0
+		s.main.chatList.SetCurrentItem(0)
+
+		clearDialogue(s)
+		resetComposer(s)
+		s.main.chat.header.name.SetText("Chat@")
+		s.main.chat.header.info.msgNum.SetText("0")
+		s.main.chat.header.info.membersNum.SetText("0")
+		s.main.chat.header.info.onlineNum.SetText("0")
+	})
 }
 
-type cmd struct {
-	name string
-	f    func(event *tcell.EventKey) *tcell.EventKey
+func handleSaveAttachment(s *appScreen, p *tview.Pages, hash, dest string) {
+	path, err := client.SaveAttachment(hash, dest)
+
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
+		if err != nil {
+			addInfoModal(p, "Unexpected error during save attachment",
+				"Encountered unexpected error during save attachment. Please look into the logs.")
+			return
+		}
+		addInfoModal(p, "Attachment saved", fmt.Sprintf("Saved to %s", path))
+	})
 }
 
-var runeCmds map[rune]cmd
-var keyCmds map[tcell.Key]cmd
+// addSaveAttachmentModal asks where to save the attachment of
+// the selected message
+func addSaveAttachmentModal(s *appScreen, p *tview.Pages) {
+	m, ok := getSelectedMsg()
+	if !ok || m.Attachment == "" || m.Deleted {
+		return
+	}
 
-func initCommands(s *appScreen, p *tview.Pages) {
-	runeCmds = make(map[rune]cmd)
-	runeCmds['m'] = cmd{name: "Members", f: showMembers()}
-	runeCmds['l'] = cmd{name: "Logs", f: switchToLogs(s, p)}
-	runeCmds['q'] = cmd{name: "Quit", f: quitApp(s)}
+	dest := client.AttachmentName(m)
+	saveForm := tview.NewForm()
+	saveForm.AddInputField("Save to", dest, 50, nil, func(newDest string) {
+		dest = newDest
+	})
+	saveForm.AddButton("Save", func() {
+		go func() {
+			handleSaveAttachment(s, p, m.Hash, dest)
+		}()
+	})
+	saveForm.AddButton("Cancel", func() {
+		closeModalForm(p)
+	})
 
-	keyCmds = make(map[tcell.Key]cmd)
-	keyCmds[tcell.KeyTab] = cmd{name: "", f: switchPanel(s)}
+	saveForm.SetButtonsAlign(tview.AlignCenter)
+	saveForm.SetBorder(true).SetTitle("Save attachment")
+	modal := createModalForm(saveForm, 7, 70)
+	p.AddPage("modal", modal, true, true)
 }
 
-func setKeyboardHandler(s *appScreen, p *tview.Pages) {
-	s.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		frontPage, _ := p.GetFrontPage()
-		if frontPage == "modal" {
-			return event
-		}
+var reactionEmojis = []string{"👍", "👎", "❤️", "😂", "😮", "🎉"}
 
-		cmd, ok := keyCmds[event.Key()]
-		if ok {
-			return cmd.f(event)
-		}
+func handleReact(s *appScreen, p *tview.Pages, hash, emoji string) {
+	_, err := client.React(hash, emoji)
+	if err != nil {
+		s.app.QueueUpdateDraw(func() {
+			closeModalForm(p)
+			addInfoModal(p, "Unexpected error during reaction",
+				"Encountered unexpected error during reaction. Please look into the logs.")
+		})
+		return
+	}
 
-		if (s.currPage != "main") || (s.main.focus.curr == msgFocusNum) {
-			return event
-		}
+	s.app.QueueUpdateDraw(func() {
+		closeModalForm(p)
+	})
+}
 
-		cmd, ok = runeCmds[event.Rune()]
-		if ok {
-			return cmd.f(event)
-		}
+// addReactModal lets pick the emoji reaction to the selected message.
+// Picking my current reaction takes it back
+func addReactModal(s *appScreen, p *tview.Pages) {
+	m, ok := getSelectedMsg()
+	if !ok || m.MergedTopic != "" || m.Deleted {
+		return
+	}
 
-		return event
+	reactForm := tview.NewForm()
+	for _, emoji := range reactionEmojis {
+		reactForm.AddButton(emoji, func() {
+			go func() {
+				handleReact(s, p, m.Hash, emoji)
+			}()
+		})
+	}
+	reactForm.AddButton("Cancel", func() {
+		closeModalForm(p)
 	})
+
+	reactForm.SetButtonsAlign(tview.AlignCenter)
+	reactForm.SetBorder(true).SetTitle("React")
+	modal := createModalForm(reactForm, 5, 60)
+	p.AddPage("modal", modal, true, true)
 }
 
-func createCommands(s *appScreen, p *tview.Pages) *tview.Flex {
-	initCommands(s, p)
+func composerStyle(color tcell.Color) tcell.Style {
+	return tcell.StyleDefault.Background(tview.Styles.PrimitiveBackgroundColor).Foreground(color)
+}
 
-	cmdContainer := tview.NewFlex()
-	for r, cmd := range runeCmds {
-		list := tview.NewList().
-			AddItem(cmd.name, "", r, nil)
-		cmdContainer.AddItem(list, 0, 1, true)
+// sendComposed sends the text as a new message, a reply or an edit,
+// depending on the composer state
+func sendComposed(s *appScreen, p *tview.Pages, text string) {
+	text = strings.TrimRight(strings.TrimLeft(text, "\n"), " \t\n")
+	if text == "" {
+		return
 	}
-	cmdContainer.SetDirection(tview.FlexColumn).SetBorder(true)
 
-	setKeyboardHandler(s, p)
+	c := s.main.chat
+	var chat client.Chat
+	var err error
+	switch {
+	case c.editing != nil:
+		chat, err = client.EditMsg(c.editing.Hash, text)
+	case c.replyTo != nil:
+		chat, err = client.SendReply(text, c.replyTo.Hash)
+	default:
+		chat, err = client.SendMsg(text)
+	}
+	if errors.Is(err, client.ErrNotPermitted) {
+		closeModalForm(p)
+		addInfoModal(p, "Cannot send message", "Your role only allows to read the chat.")
+		return
+	}
+	if err != nil {
+		closeModalForm(p)
+		addInfoModal(p, "Unexpected error during send message",
+			"Encountered unexpected error during send message. Please look into the logs.")
+		return
+	}
+	c.message.SetText("", false)
+	resetComposer(s)
+	updateChatHeader(s, chat)
+	updChatInList(s, p, s.main.selectChatIndex, chat)
+}
 
-	return cmdContainer
+func getEditor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := strings.Fields(os.Getenv(env)); len(editor) > 0 {
+			return editor
+		}
+	}
+	return []string{"vi"}
 }
 
-func isDifferentDay(d1, d2 time.Time) bool {
-	year1, month1, day1 := d1.Date()
-	year2, month2, day2 := d2.Date()
+// composeInEditor opens $EDITOR on a temp file with the composer text
+// and sends what is saved there
+func composeInEditor(s *appScreen, p *tview.Pages) {
+	f, err := os.CreateTemp("", "gitogram-*.txt")
+	if err != nil {
+		appConfig.LogErr(err, "creating message file")
+		return
+	}
+	defer os.Remove(f.Name())
 
-	return year1 != year2 || month1 != month2 || day1 != day2
-}
+	_, err = f.WriteString(s.main.chat.message.GetText())
+	f.Close()
+	if err != nil {
+		appConfig.LogErr(err, "writing message file %s", f.Name())
+		return
+	}
 
-var prevDate time.Time
+	editor := getEditor()
+	s.app.Suspend(func() {
+		cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err = cmd.Run()
+	})
+	if err != nil {
+		appConfig.LogErr(err, "running editor %s", editor[0])
+		addInfoModal(p, "Cannot open editor",
+			fmt.Sprintf("Failed to run %s. Please set $EDITOR and look into the logs.", editor[0]))
+		return
+	}
 
-func newDate(t time.Time) bool {
-	if (prevDate == (time.Time{})) || isDifferentDay(prevDate, t) {
-		prevDate = t
-		return true
+	text, err := os.ReadFile(f.Name())
+	if err != nil {
+		appConfig.LogErr(err, "reading message file %s", f.Name())
+		return
 	}
-	return false
+	sendComposed(s, p, string(text))
 }
 
-func dialogueNewDate(t time.Time) string {
-	if time.Now().Year() != t.Year() {
-		return t.Format("January 2, 2006")
+func focusComposer(s *appScreen) {
+	panel, err := s.main.focus.setPanel(msgFocusNum)
+	if err != nil {
+		return
 	}
-	return t.Format("January 2")
+	s.app.SetFocus(panel)
+	s.main.highlightPanel(panel)
 }
 
-func splitString(s, open, clos string, splitLen, padding int) []string {
-	var chunks []string
+func resetComposer(s *appScreen) {
+	if s.main.chat.editing != nil {
+		s.main.chat.message.SetText("", false)
+	}
+	s.main.chat.replyTo = nil
+	s.main.chat.editing = nil
+	s.main.chat.message.SetLabel("")
+}
 
-	for i := 0; i < len(s); i += splitLen {
-		end := i + splitLen
-		fillSpaces := 0
-		if end > len(s) {
-			fillSpaces = end - len(s)
-			end = len(s)
-		}
-		chunks = append(chunks, fmt.Sprintf("%*s", padding, open+s[i:end]+strings.Repeat(" ", fillSpaces)+clos))
+func msgDetails(chat client.Chat, m client.Message) string {
+	var b strings.Builder
+	if name := client.VisibleName(chat, m.Author); name != m.Author {
+		fmt.Fprintf(&b, "Author: %s (%s)\n", name, m.Author)
+	} else {
+		fmt.Fprintf(&b, "Author: %s\n", m.Author)
+	}
+	fmt.Fprintf(&b, "Time: %s\n", m.Time.Format("02.01.2006 15:04:05"))
+	fmt.Fprintf(&b, "Hash: %s\n", m.Hash)
+	if m.ReplyTo != "" {
+		fmt.Fprintf(&b, "Reply to: %s\n", m.ReplyTo)
+	}
+	switch {
+	case m.Signature == client.SignatureVerified && m.Signer != m.Author:
+		fmt.Fprintf(&b, "Signature: verified, signed by %s, not the author\n", m.Signer)
+	case m.Signature != client.SignatureNone:
+		fmt.Fprintf(&b, "Signature: %s\n", m.Signature)
 	}
 
-	return chunks
-}
+	if len(m.Reactions) > 0 {
+		usernames := make([]string, 0, len(m.Reactions))
+		for username := range m.Reactions {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
 
-func getColorFromUsername(username string) string {
-	hash := sha256.New()
-	hash.Write([]byte(username))
-	hashSum := hash.Sum(nil)
+		b.WriteString("\nReactions:\n")
+		for _, username := range usernames {
+			fmt.Fprintf(&b, "%s %s\n", m.Reactions[username], username)
+		}
+	}
 
-	r := hashSum[0]
-	g := hashSum[1]
-	b := hashSum[2]
+	if len(m.SeenBy) > 0 {
+		fmt.Fprintf(&b, "\nSeen by: %s\n", strings.Join(m.SeenBy, ", "))
+	}
 
-	color := fmt.Sprintf("#%02x%02x%02x", r, g, b)
-	return color
+	if len(m.History) > 0 {
+		b.WriteString("\nEdit history:\n")
+		for _, h := range m.History {
+			fmt.Fprintf(&b, "[%s] %s\n", h.Time.Format("02.01.2006 15:04"), h.Text)
+		}
+		fmt.Fprintf(&b, "[%s] %s\n", m.EditTime.Format("02.01.2006 15:04"), m.Text)
+	}
+	return b.String()
 }
 
-var dialogue *log.Logger
-
-func printMsg(s *appScreen, m client.Message) {
-	usernameColor := getColorFromUsername(m.Author)
+// showMsgDetails opens the detail view of the selected message
+func showMsgDetails(s *appScreen, p *tview.Pages) {
+	m, ok := getSelectedMsg()
+	if !ok {
+		return
+	}
+	// Receipts may have come after the message was printed
+	if fresh, err := client.GetMsg(m.Hash); err == nil {
+		m = fresh
+	}
 
-	username, err := client.GetUserName()
+	detailsForm := tview.NewForm()
+	chat, err := client.GetCurrChat()
 	if err != nil {
 		return
 	}
+	detailsForm.AddTextView("", tview.Escape(msgDetails(chat, m)), 0, 14, true, true)
+	detailsForm.AddButton("Close", func() {
+		closeModalForm(p)
+	})
 
-	bgColor := ""
-	if m.Author == username {
-		bgColor = "gray"
-	}
+	detailsForm.SetButtonsAlign(tview.AlignCenter)
+	detailsForm.SetBorder(true).SetTitle("Message")
+	modal := createModalForm(detailsForm, 20, 80)
+	p.AddPage("modal", modal, true, true)
+}
 
-	if newDate(m.Time) {
-		dialogue.Println("[:blue]---------->>> " + dialogueNewDate(m.Time) + "[-:-:-:-]\n")
+// toggleMsg expands or collapses the selected event, e.g. merged topic
+func toggleMsg(s *appScreen) {
+	m, ok := getSelectedMsg()
+	if !ok || m.MergedTopic == "" {
+		return
 	}
 
-	msg := fmt.Sprintf("[%s:%s:b]%s [%s][-::-:-]\n%s[-:-:-:-]\n", usernameColor, bgColor, m.Author, m.Time.Format("15:04"), m.Text)
-	dialogue.Println(msg)
-	s.main.chat.dialogue.ScrollToEnd()
+	dlg.mu.Lock()
+	dlg.expanded[m.Hash] = !dlg.expanded[m.Hash]
+	dlg.mu.Unlock()
+
+	redrawDialogue(s)
 }
 
 var msgChann chan client.Message
@@ -766,10 +2830,20 @@ func createApp() (*tview.Application, error) {
 	screen.log.focus = &focusStruct{}
 	screen.log.focus.panels = []tview.Primitive{screen.log.text, screen.log.button}
 
+	screen.search = createSearch(screen, pages)
+	screen.search.focus = &focusStruct{}
+	screen.search.focus.panels = []tview.Primitive{screen.search.query, screen.search.results, screen.search.button}
+
+	screen.members = createMembers(screen, pages)
+	screen.members.focus = &focusStruct{}
+	screen.members.focus.panels = []tview.Primitive{screen.members.list, screen.members.button}
+
 	setOutputs(screen)
 
 	pages.AddPage("main", screen.main.panel, true, true)
 	pages.AddPage("log", screen.log.panel, true, false)
+	pages.AddPage("search", screen.search.panel, true, false)
+	pages.AddPage("members", screen.members.panel, true, false)
 	screen.currPage, _ = pages.GetFrontPage()
 
 	screen.app.SetRoot(pages, true)